@@ -17,6 +17,8 @@ const DEFAULT_VISCOSITY float32 = 1
 
 type settings struct {
 	Size 	  int     `json:"size"`
+	Width 	  int     `json:"width"`	 // Optional, defaults to size
+	Height 	  int     `json:"height"`	 // Optional, defaults to size
     Frames 	  uint    `json:"frames"`
     SimType   string  `json:"simType"`
 	OutPath   string  `json:"outPath"`
@@ -25,9 +27,13 @@ type settings struct {
 	Delay 	  int     `json:"delay"`	 // Optional
 	Repeat	  int	  `json:"repeat"`    // Optional
 	FadeOut	  bool	  `json:"fadeOut"`	 // Optional
+
+	fluid.Options						 // Optional, solver settings (see fluid/options.go)
 }
 
 func initializeSettings(s *settings) {
+	if s.Width == 0 { s.Width = s.Size }
+	if s.Height == 0 { s.Height = s.Size }
 	if s.Delay == 0 { s.Delay = DEFAULT_DELAY }
 	if s.Diffusion == 0 { s.Diffusion = DEFAULT_DIFFUSION }
 	if s.Viscosity == 0 { s.Viscosity = DEFAULT_VISCOSITY }
@@ -45,7 +51,8 @@ func sequential() {
 
 		// create simulation
 		fsGIF := fluid.FluidSimulationGIFCreate(
-			input.Size,
+			input.Width,
+			input.Height,
 			input.Frames,
 			input.Delay,
 			input.SimType,
@@ -56,10 +63,12 @@ func sequential() {
 			input.OutPath,
 			0,
 			false,
+			input.Options,
 		)
 
 		// run simulation
 		fsGIF.Run()
+		fsGIF.Close()
 
 		// save simulation
 		fsGIF.Save()
@@ -117,7 +126,8 @@ func main() {
 
 		// create simulation
 		fsGIF := fluid.FluidSimulationGIFCreate(
-			input.Size,
+			input.Width,
+			input.Height,
 			input.Frames,
 			input.Delay,
 			input.SimType,
@@ -128,6 +138,7 @@ func main() {
 			input.OutPath,
 			*threadCount,
 			*bspMode,
+			input.Options,
 		)
 		task := fluid.TaskCreate(fsGIF)
 		tasks <- task
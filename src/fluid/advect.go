@@ -0,0 +1,189 @@
+package fluid
+
+// Higher order alternatives to advect (see Options.Advection). advect is first
+// order, every tick the bilinear interpolation blurs the field a little more.
+//
+//   maccormack: advect forwards then backwards, half the difference to the start
+//               is the error of the forward step and gets corrected (Selle et al. 2008)
+//   bfecc:      back and forth error compensation, the error is removed from the
+//               field before it's advected again (Kim et al. 2005)
+//   cubic:      advect with monotonic cubic instead of bilinear interpolation
+//               (Fedkiw, Stam and Jensen 2001)
+//
+// The results are clamped to the cells the backtraced position lies between so the
+// corrections can't overshoot and create new extremes (which would oscillate).
+
+
+//
+// Advection functions
+//
+
+// Advects with one of the schemes of Options.Advection, maccormack and bfecc need
+// the 2 scratch arrays
+func advect_scheme[T Float](scheme string, b int, d, d0, velocX, velocY []T, dt T, g *grid, scratch0, scratch1 []T) {
+	switch scheme {
+	case "maccormack":
+		advect_maccormack(b, d, d0, velocX, velocY, dt, g, scratch0, scratch1)
+	case "bfecc":
+		advect_bfecc(b, d, d0, velocX, velocY, dt, g, scratch0, scratch1)
+	case "cubic":
+		advect_cubic(b, d, d0, velocX, velocY, dt, g)
+	default:
+		advect(b, d, d0, velocX, velocY, dt, g)
+	}
+}
+
+func advect_maccormack[T Float](b int, d, d0, velocX, velocY []T, dt T, g *grid, forward, backward []T) {
+	advect(b, forward, d0, velocX, velocY, dt, g)
+	advect(b, backward, forward, velocX, velocY, -dt, g)
+
+	W, H := g.W, g.H
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				value := forward[index] + 0.5 * (d0[index] - backward[index])
+				d[index] = limit(value, d0, i, j, velocX, velocY, dt, g)
+			}
+		}
+	})
+	set_bnd(b, d, g)
+}
+
+func advect_bfecc[T Float](b int, d, d0, velocX, velocY []T, dt T, g *grid, forward, backward []T) {
+	advect(b, forward, d0, velocX, velocY, dt, g)
+	advect(b, backward, forward, velocX, velocY, -dt, g)
+
+	// corrected field in backward, then advected for real
+	W, H := g.W, g.H
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				backward[index] = d0[index] + 0.5 * (d0[index] - backward[index])
+			}
+		}
+	})
+	set_bnd(b, backward, g)
+	advect(b, forward, backward, velocX, velocY, dt, g)
+
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				d[ix(i, j, W)] = limit(forward[ix(i, j, W)], d0, i, j, velocX, velocY, dt, g)
+			}
+		}
+	})
+	set_bnd(b, d, g)
+}
+
+func advect_cubic[T Float](b int, d, d0, velocX, velocY []T, dt T, g *grid) {
+	W, H := g.W, g.H
+	periodicX, periodicY := g.bnd.periodicX(), g.bnd.periodicY()
+
+	g.pool.forRows(1, H-1, func(start, end int) {
+		var rows [4]T
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				x, y := backtrace(i, j, velocX, velocY, dt, g)
+				i0, j0 := int(floorf(x)), int(floorf(y))
+				s, t := x - T(i0), y - T(j0)
+
+				// interpolate along the 4 rows around the position, then between them
+				for r:=0; r<4; r++ {
+					row := cubic_index(j0 - 1 + r, H, periodicY) * W
+					rows[r] = monotonic_cubic(
+						d0[row + cubic_index(i0-1, W, periodicX)],
+						d0[row + cubic_index(i0, W, periodicX)],
+						d0[row + cubic_index(i0+1, W, periodicX)],
+						d0[row + cubic_index(i0+2, W, periodicX)], s)
+				}
+				value := monotonic_cubic(rows[0], rows[1], rows[2], rows[3], t)
+				d[ix(i, j, W)] = limit(value, d0, i, j, velocX, velocY, dt, g)
+			}
+		}
+	})
+	set_bnd(b, d, g)
+}
+
+
+//
+// Helper functions
+//
+
+// Position cell (i, j) came from dt ago, clamped (or wrapped) the same way as in
+// advect so the 4 cells around it are inside the grid
+func backtrace[T Float](i, j int, velocX, velocY []T, dt T, g *grid) (T, T) {
+	W, H, N := g.W, g.H, g.N
+	index := ix(i, j, W)
+	x := T(i) - dt * T(N-2) * velocX[index]
+	y := T(j) - dt * T(N-2) * velocY[index]
+
+	Wfloat, Hfloat := T(W), T(H)
+	if g.bnd.periodicX() {
+		x = wrap(x, Wfloat)
+	} else {
+		if !(x >= 0.5) { x = 0.5 }
+		if x > Wfloat - 1.5 { x = Wfloat - 1.5 }
+	}
+	if g.bnd.periodicY() {
+		y = wrap(y, Hfloat)
+	} else {
+		if !(y >= 0.5) { y = 0.5 }
+		if y > Hfloat - 1.5 { y = Hfloat - 1.5 }
+	}
+	return x, y
+}
+
+// Clamps value between the smallest and largest of the 4 cells of d0 that cell
+// (i, j) is advected from
+func limit[T Float](value T, d0 []T, i, j int, velocX, velocY []T, dt T, g *grid) T {
+	W := g.W
+	x, y := backtrace(i, j, velocX, velocY, dt, g)
+	i0, j0 := int(floorf(x)), int(floorf(y))
+
+	a, b := d0[ix(i0, j0, W)], d0[ix(i0+1, j0, W)]
+	c, d := d0[ix(i0, j0+1, W)], d0[ix(i0+1, j0+1, W)]
+	min, max := a, a
+	for _, v := range [3]T{b, c, d} {
+		if v < min { min = v }
+		if v > max { max = v }
+	}
+
+	if value < min { return min }
+	if value > max { return max }
+	return value
+}
+
+// Interpolates between f1 and f2 (t from 0 to 1) with a cubic through f0..f3. The
+// slopes are zeroed where they disagree with the sign of f2-f1 so the curve can't
+// overshoot between the two cells.
+func monotonic_cubic[T Float](f0, f1, f2, f3, t T) T {
+	delta := f2 - f1
+	d1 := (f2 - f0) / 2
+	d2 := (f3 - f1) / 2
+
+	if delta == 0 {
+		d1, d2 = 0, 0
+	} else {
+		if d1 * delta < 0 { d1 = 0 }
+		if d2 * delta < 0 { d2 = 0 }
+	}
+
+	a3 := d1 + d2 - 2 * delta
+	a2 := 3 * delta - 2 * d1 - d2
+	return ((a3 * t + a2) * t + d1) * t + f1
+}
+
+// Row or column used for the outer points of the cubic, they wrap around on
+// periodic axes and are clamped to the grid otherwise
+func cubic_index(i, N int, periodic bool) int {
+	if periodic {
+		if i < 1 { return i + N - 2 }
+		if i > N - 2 { return i - (N - 2) }
+		return i
+	}
+	if i < 0 { return 0 }
+	if i > N - 1 { return N - 1 }
+	return i
+}
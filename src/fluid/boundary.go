@@ -0,0 +1,99 @@
+package fluid
+
+// Edge is the boundary condition on one side of the grid
+type Edge struct {
+	Type string  `json:"type"` // "free-slip" (default), "wall", "periodic", "inflow" or "outflow"
+	Vx   float32 `json:"vx"`   // velocity of the fluid coming in through an inflow edge
+	Vy   float32 `json:"vy"`
+}
+
+// Boundaries holds the boundary conditions of the 4 sides of the grid. Top is the
+// y=0 row (the top of the gif). Periodic edges have to come in opposite pairs.
+//
+//   free-slip: the original walls, fluid can't go through them but slides along them
+//   wall:      no-slip wall, the fluid sticks to it
+//   periodic:  fluid leaving through this side comes back in through the opposite one
+//   inflow:    fluid comes in at the fixed velocity (vx, vy)
+//   outflow:   open side, everything leaves with zero gradient and the pressure is 0
+type Boundaries struct {
+	Left   Edge `json:"left"`
+	Right  Edge `json:"right"`
+	Top    Edge `json:"top"`
+	Bottom Edge `json:"bottom"`
+}
+
+
+//
+// Boundaries functions
+//
+
+// panics on unknown edge types or periodic edges without a periodic partner
+func (bnd *Boundaries) validate() {
+	for _, e := range [4]Edge{bnd.Left, bnd.Right, bnd.Top, bnd.Bottom} {
+		switch e.Type {
+		case "", "free-slip", "wall", "periodic", "inflow", "outflow":
+		default:
+			panic("Unknown boundary type: " + e.Type)
+		}
+	}
+	if (bnd.Left.Type == "periodic") != (bnd.Right.Type == "periodic") ||
+		(bnd.Top.Type == "periodic") != (bnd.Bottom.Type == "periodic") {
+		panic("Periodic boundaries have to be on opposite edges")
+	}
+}
+
+func (bnd *Boundaries) periodicX() bool {
+	return bnd.Left.Type == "periodic"
+}
+
+func (bnd *Boundaries) periodicY() bool {
+	return bnd.Top.Type == "periodic"
+}
+
+// true if an edge holds the pressure at 0, otherwise it's only known up to a constant
+func (bnd *Boundaries) open() bool {
+	for _, e := range [4]Edge{bnd.Left, bnd.Right, bnd.Top, bnd.Bottom} {
+		if e.Type == "outflow" {
+			return true
+		}
+	}
+	return false
+}
+
+// Value set_bnd gives a boundary cell. inside is the interior cell next to it,
+// wrapped the interior cell on the opposite side of the grid and normal the
+// velocity component (1 or 2) that points through the edge. b is 0 for scalars,
+// 1/2 for the x/y velocity and 3 for the pressure.
+func edge_value[T Float](b, normal int, e *Edge, inside, wrapped T) T {
+	switch e.Type {
+	case "periodic":
+		return wrapped
+	case "inflow":
+		if b == 1 { return T(e.Vx) }
+		if b == 2 { return T(e.Vy) }
+		return inside
+	case "outflow":
+		// pressure is 0 on the edge itself
+		if b == 3 { return -inside }
+		return inside
+	case "wall":
+		if b == 1 || b == 2 { return -inside }
+		return inside
+	default:
+		if b == normal { return -inside }
+		return inside
+	}
+}
+
+// how much of a cell's own pressure comes back to it through the ghost cell of
+// this edge (see grid.weight)
+func edge_weight(e *Edge) float32 {
+	switch e.Type {
+	case "periodic":
+		return 0
+	case "outflow":
+		return -1
+	default:
+		return 1
+	}
+}
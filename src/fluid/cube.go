@@ -2,27 +2,54 @@ package fluid
 
 type densityCube interface {
 	Density(x int, y int) float32
+	Solid(x int, y int) bool
+	Dye(channel int, x int, y int) float32
+	DyeCount() int
 }
 
 type cacheCube struct {
-	size int
+	width int
+	height int
 	density []float32
+	solid []bool
+	dyes [][]float32
 }
 
-func cacheCubeCreate(size int) *cacheCube {
-	density := make([]float32, size*size)
-	return &cacheCube{size, density}
+func cacheCubeCreate(width, height, dyeCount int) *cacheCube {
+	density := make([]float32, width*height)
+	solid := make([]bool, width*height)
+	dyes := make([][]float32, dyeCount)
+	for channel := range dyes {
+		dyes[channel] = make([]float32, width*height)
+	}
+	return &cacheCube{width, height, density, solid, dyes}
 }
 
 func (cache *cacheCube) SaveState(cube densityCube) {
-	for y:=0; y<cache.size; y++ {
-		for x:=0; x<cache.size; x++ {
-			index := ix(x, y, cache.size)
+	for y:=0; y<cache.height; y++ {
+		for x:=0; x<cache.width; x++ {
+			index := ix(x, y, cache.width)
 			cache.density[index] = cube.Density(x, y) 
+			cache.solid[index] = cube.Solid(x, y)
+			for channel := range cache.dyes {
+				cache.dyes[channel][index] = cube.Dye(channel, x, y)
+			}
 		}
 	}
 }
 
 func (cache *cacheCube) Density(x, y int) float32 {
-	return cache.density[ix(x, y, cache.size)]
-}
\ No newline at end of file
+	return cache.density[ix(x, y, cache.width)]
+}
+
+func (cache *cacheCube) Solid(x, y int) bool {
+	return cache.solid[ix(x, y, cache.width)]
+}
+
+func (cache *cacheCube) Dye(channel, x, y int) float32 {
+	return cache.dyes[channel][ix(x, y, cache.width)]
+}
+
+func (cache *cacheCube) DyeCount() int {
+	return len(cache.dyes)
+}
@@ -0,0 +1,168 @@
+package fluid
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Diagnostics are measured over the interior fluid cells after a Step, they show
+// whether a run is stable long before it's visible in the gif. The grid is 1 unit
+// long on its longer side like in advect.
+type Diagnostics struct {
+	Mass          float64 `json:"mass"`          // density + every dye channel summed over the cells
+	KineticEnergy float64 `json:"kineticEnergy"` // 1/2 |v|^2 integrated over the grid
+	Enstrophy     float64 `json:"enstrophy"`     // 1/2 vorticity^2 integrated over the grid, how much the fluid swirls
+	MaxVelocity   float64 `json:"maxVelocity"`   // largest |v|
+	MaxDivergence float64 `json:"maxDivergence"` // largest |div v|, how much the projection left behind
+}
+
+// diagnosticsLog writes a Diagnostics line per tick to a CSV or JSONL file
+type diagnosticsLog struct {
+	file   *os.File
+	writer *bufio.Writer
+	json   bool // JSONL instead of CSV
+}
+
+
+//
+// Diagnostics functions
+//
+
+// false if any of the values is NaN or infinite
+func (d *Diagnostics) Finite() bool {
+	for _, value := range [5]float64{d.Mass, d.KineticEnergy, d.Enstrophy, d.MaxVelocity, d.MaxDivergence} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+
+//
+// diagnosticsLog functions
+//
+
+// The format is picked by the file extension, ".csv" or ".jsonl"
+func diagnosticsLogCreate(path string) (*diagnosticsLog, error) {
+	var isJSON bool
+	switch filepath.Ext(path) {
+	case ".csv":
+	case ".jsonl":
+		isJSON = true
+	default:
+		return nil, fmt.Errorf("diagnostics file has to be .csv or .jsonl: %s", path)
+	}
+
+	file, err := os.Create(path); if err != nil {
+		return nil, err
+	}
+	log := &diagnosticsLog{file, bufio.NewWriter(file), isJSON}
+	if !isJSON {
+		_, err = log.writer.WriteString("tick,dt,mass,kineticEnergy,enstrophy,maxVelocity,maxDivergence\n"); if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+func (log *diagnosticsLog) Write(tick int, dt float32, d Diagnostics) error {
+	if log.json {
+		_, err := fmt.Fprintf(log.writer,
+			`{"tick":%d,"dt":%s,"mass":%s,"kineticEnergy":%s,"enstrophy":%s,"maxVelocity":%s,"maxDivergence":%s}`+"\n",
+			tick, json_number(float64(dt), 32), json_number(d.Mass, 64), json_number(d.KineticEnergy, 64), json_number(d.Enstrophy, 64),
+			json_number(d.MaxVelocity, 64), json_number(d.MaxDivergence, 64))
+		return err
+	}
+	_, err := fmt.Fprintf(log.writer, "%d,%g,%g,%g,%g,%g,%g\n", tick, dt,
+		d.Mass, d.KineticEnergy, d.Enstrophy, d.MaxVelocity, d.MaxDivergence)
+	return err
+}
+
+// flushes + closes the file
+func (log *diagnosticsLog) Close() error {
+	err := log.writer.Flush(); if err != nil {
+		log.file.Close()
+		return err
+	}
+	return log.file.Close()
+}
+
+
+//
+// Helper functions
+//
+
+// Measures a backend's arrays. The derivatives are central differences, h is the
+// width of a cell. The rows are measured across the worker pool and added up in
+// row order so the result doesn't depend on the thread count. NaNs + infinities
+// are kept (math.Max passes NaN on) so Finite catches them.
+func diagnose[T Float](g *grid, density []T, dyes [][]T, Vx, Vy []T) Diagnostics {
+	W, H := g.W, g.H
+	h := 1 / float64(g.N-2)
+
+	// obstacles don't move, their cells hold the mirrored velocity set_bnd needs
+	velocity := func(index int) (float64, float64) {
+		if !g.fluid(index) {
+			return 0, 0
+		}
+		return float64(Vx[index]), float64(Vy[index])
+	}
+
+	rows := make([]Diagnostics, H)
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for y:=start; y<end; y++ {
+			d := &rows[y]
+			for x:=1; x<W-1; x++ {
+				index := ix(x, y, W)
+				if !g.fluid(index) {
+					continue
+				}
+
+				d.Mass += float64(density[index])
+				for _, dye := range dyes {
+					d.Mass += float64(dye[index])
+				}
+
+				vx, vy := velocity(index)
+				speed2 := vx*vx + vy*vy
+				d.KineticEnergy += 0.5 * speed2 * h * h
+				d.MaxVelocity = math.Max(d.MaxVelocity, math.Sqrt(speed2))
+
+				rightX, rightY := velocity(index+1)
+				leftX, leftY := velocity(index-1)
+				downX, downY := velocity(index+W)
+				upX, upY := velocity(index-W)
+
+				divergence := (rightX - leftX + downY - upY) / (2*h)
+				vorticity := (rightY - leftY - (downX - upX)) / (2*h)
+				d.Enstrophy += 0.5 * vorticity * vorticity * h * h
+				d.MaxDivergence = math.Max(d.MaxDivergence, math.Abs(divergence))
+			}
+		}
+	})
+
+	var d Diagnostics
+	for _, row := range rows[1:H-1] {
+		d.Mass += row.Mass
+		d.KineticEnergy += row.KineticEnergy
+		d.Enstrophy += row.Enstrophy
+		d.MaxVelocity = math.Max(d.MaxVelocity, row.MaxVelocity)
+		d.MaxDivergence = math.Max(d.MaxDivergence, row.MaxDivergence)
+	}
+	return d
+}
+
+// Formats a float with bits precision. json has no NaN or infinity, they're
+// written as the strings "NaN", "+Inf" and "-Inf".
+func json_number(value float64, bits int) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return strconv.Quote(strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	return strconv.FormatFloat(value, 'g', -1, bits)
+}
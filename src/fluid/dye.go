@@ -0,0 +1,31 @@
+package fluid
+
+import (
+	"image/color"
+)
+
+// Dye is an extra coloured dye channel. Every channel is advected by the fluid and
+// diffused separately, the frames show the sum of all their colours.
+type Dye struct {
+	Color     [3]float32 `json:"color"`     // red, green + blue between 0 and 1 of one unit of dye
+	Diffusion float32    `json:"diffusion"` // how fast this dye spreads out (default the cube's diffusion)
+}
+
+
+//
+// Helper functions
+//
+
+// Colour of a cell with dye channels, the original density channel is drawn in white
+// underneath them
+func composite(cube densityCube, dyes []Dye, x, y int) color.RGBA64 {
+	white := cube.Density(x, y)
+	r, g, b := white, white, white
+	for channel, dye := range dyes {
+		amount := cube.Dye(channel, x, y)
+		r += amount * dye.Color[0]
+		g += amount * dye.Color[1]
+		b += amount * dye.Color[2]
+	}
+	return color.RGBA64{scale(r), scale(g), scale(b), 0xFFFF}
+}
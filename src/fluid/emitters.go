@@ -0,0 +1,147 @@
+package fluid
+
+import (
+	"sort"
+)
+
+const DEFAULT_EMITTER_RADIUS float32 = 1
+
+// Emitter adds dye, velocity and heat to a disc of cells every tick while it's on.
+// The centre stays at (x, y) or follows the keyframes:
+//
+//   linear: straight lines between the keyframes
+//   bezier: a smooth curve through the keyframes, every segment is a cubic bezier
+//           with Catmull-Rom control points so the direction doesn't jump at them
+//
+// Before the first keyframe the emitter sits on it, after the last one it stays there.
+type Emitter struct {
+	X           float32    `json:"x"`           // centre in cells if there are no keyframes
+	Y           float32    `json:"y"`
+	Radius      float32    `json:"radius"`      // cells whose centre is within this distance get emitted into (default 1)
+	Amount      float32    `json:"amount"`      // dye added to every cell per tick
+	Dye         int        `json:"dye"`         // dye channel the amount goes into, ignored without dye channels (then it's the density)
+	VX          float32    `json:"vx"`          // velocity added to every cell per tick
+	VY          float32    `json:"vy"`
+	Temperature float32    `json:"temperature"` // heat added to every cell per tick, turns the temperature field on
+	Start       int        `json:"start"`       // first tick the emitter is on
+	End         int        `json:"end"`         // tick the emitter turns off at, 0 keeps it on until the end
+	Path        string     `json:"path"`        // how the centre moves between keyframes: "linear" (default) or "bezier"
+	Keyframes   []Keyframe `json:"keyframes"`   // where the centre is at which tick
+}
+
+// Keyframe is a position an Emitter passes through
+type Keyframe struct {
+	Tick int     `json:"tick"`
+	X    float32 `json:"x"`
+	Y    float32 `json:"y"`
+}
+
+
+//
+// Emitter functions
+//
+
+// fills in defaults and panics on unknown settings, dyes is the number of dye channels
+func (e *Emitter) initialize(dyes int) {
+	switch e.Path {
+	case "", "linear", "bezier":
+	default:
+		panic("Unknown emitter path: " + e.Path)
+	}
+	if e.Radius <= 0 { e.Radius = DEFAULT_EMITTER_RADIUS }
+	if dyes > 0 && (e.Dye < 0 || e.Dye >= dyes) {
+		panic("Emitter dye channel out of range")
+	}
+	if !sort.SliceIsSorted(e.Keyframes, func(a, b int) bool { return e.Keyframes[a].Tick < e.Keyframes[b].Tick }) {
+		panic("Emitter keyframes have to be sorted by tick")
+	}
+}
+
+func (e *Emitter) active(tick int) bool {
+	return tick >= e.Start && (e.End == 0 || tick < e.End)
+}
+
+// centre of the emitter at a tick
+func (e *Emitter) position(tick int) (float32, float32) {
+	frames := e.Keyframes
+	if len(frames) == 0 {
+		return e.X, e.Y
+	}
+	if tick <= frames[0].Tick {
+		return frames[0].X, frames[0].Y
+	}
+	last := len(frames) - 1
+	if tick >= frames[last].Tick {
+		return frames[last].X, frames[last].Y
+	}
+
+	// segment from keyframe k to k+1 (their ticks differ, tick is strictly between them)
+	k := sort.Search(len(frames), func(i int) bool { return frames[i].Tick > tick }) - 1
+	p1, p2 := frames[k], frames[k+1]
+	t := float32(tick - p1.Tick) / float32(p2.Tick - p1.Tick)
+
+	if e.Path != "bezier" {
+		return p1.X + t * (p2.X - p1.X), p1.Y + t * (p2.Y - p1.Y)
+	}
+	p0, p3 := p1, p2
+	if k > 0 { p0 = frames[k-1] }
+	if k+2 <= last { p3 = frames[k+2] }
+	return bezier(p1.X, p1.X + (p2.X - p0.X) / 6, p2.X - (p3.X - p1.X) / 6, p2.X, t),
+		bezier(p1.Y, p1.Y + (p2.Y - p0.Y) / 6, p2.Y - (p3.Y - p1.Y) / 6, p2.Y, t)
+}
+
+// Adds this tick's dye, velocity + heat to the interior cells in the disc, solid
+// cells are left alone
+func (e *Emitter) emit(cube *FluidCube, tick int) {
+	W, H := cube.Width(), cube.Height()
+	cx, cy := e.position(tick)
+	x0, x1 := int(floorf(cx - e.Radius)), int(floorf(cx + e.Radius))
+	y0, y1 := int(floorf(cy - e.Radius)), int(floorf(cy + e.Radius))
+	if x0 < 1 { x0 = 1 }
+	if y0 < 1 { y0 = 1 }
+	if x1 > W-2 { x1 = W-2 }
+	if y1 > H-2 { y1 = H-2 }
+
+	dyes := cube.DyeCount()
+	for y:=y0; y<=y1; y++ {
+		for x:=x0; x<=x1; x++ {
+			dx, dy := float32(x) - cx, float32(y) - cy
+			if dx*dx + dy*dy > e.Radius*e.Radius || cube.Solid(x, y) {
+				continue
+			}
+			if e.Amount != 0 {
+				if dyes > 0 {
+					cube.AddDye(e.Dye, x, y, e.Amount)
+				} else {
+					cube.AddDensity(x, y, e.Amount)
+				}
+			}
+			if e.VX != 0 || e.VY != 0 {
+				cube.AddVelocity(x, y, e.VX, e.VY)
+			}
+			if e.Temperature != 0 {
+				cube.AddTemperature(x, y, e.Temperature)
+			}
+		}
+	}
+}
+
+
+//
+// Helper functions
+//
+
+// runs every emitter that's on this tick
+func emitters(sim *Simulation) {
+	for i := range sim.emitters {
+		if sim.emitters[i].active(sim.tick) {
+			sim.emitters[i].emit(sim.cube, sim.tick)
+		}
+	}
+}
+
+// cubic bezier from p0 to p3 with control points p1 + p2, t from 0 to 1
+func bezier(p0, p1, p2, p3, t float32) float32 {
+	s := 1 - t
+	return s*s*s*p0 + 3*s*s*t*p1 + 3*s*t*t*p2 + t*t*t*p3
+}
@@ -0,0 +1,491 @@
+package fluid
+
+// flipCube is the particle-in-cell backend (Options.Backend "flip" or "pic"). Marker
+// particles carry the velocity, density, dye channels and temperature and move
+// through the grid, the grid is only used for the forces and the pressure
+// projection. Every step:
+//
+//   1. the forces, viscosity and pressure projection are applied to the grid velocity
+//   2. the particles pick up the new grid velocity (grid to particles)
+//   3. the particles are moved through the grid velocity (RK2)
+//   4. the particles are splatted back onto the grid (particles to grid)
+//
+// PIC gives the particles the interpolated grid velocity, which smooths it like
+// advect does. FLIP only adds the change of the grid velocity in the step so the
+// particles keep their small scale motion, it's blended with a little PIC to keep
+// the noise down. The scalars are always FLIP transferred, anything added to the
+// grid (AddDensity etc.) between steps ends up on the particles around the cell.
+type flipCube[T Float] struct {
+	width 	int	// cells across, including the boundary cells
+	height 	int	// cells down, including the boundary cells
+	dt 	 	T 	// length of the timestep (chosen every tick in adaptive mode)
+	maxDt 	T 	// fixed timestep, the upper bound of dt in adaptive mode
+	visc 	T 	// viscosity (how thick the fluid is)
+	ratio 	T 	// how much of the particle velocity is FLIP, the rest is PIC
+
+	Vx 		[]T // grid velocity array
+	Vy 		[]T // grid velocity array
+	Vx0 	[]T // scratch space velocity array, also the pressure + divergence in project
+	Vy0 	[]T // scratch space velocity array, also the pressure + divergence in project
+	savedVx []T // grid velocity the particles were splatted into, FLIP adds the change since
+	savedVy []T // grid velocity the particles were splatted into, FLIP adds the change since
+
+	fields 	[][]T // scalar grid fields carried by the particles: density, dyes + temperature
+	saved 	[][]T // the fields the particles were splatted into
+
+	density 	[]T   // density array (fields[0])
+	dyes 		[][]T // extra dye channels (see Options.Dyes)
+	temperature []T   // temperature array (nil if disabled)
+
+	curl 	[]T // scratch space for vorticity confinement (nil if disabled)
+
+	particles []particle[T] // position + velocity of every particle
+	values 	  [][]T         // the particles' value of each field, values[field][particle]
+	cellStart []int         // particles of cell i are order[cellStart[i]:cellStart[i+1]]
+	cellNext  []int         // scratch space for sorting the particles into order
+	order 	  []int         // particle indices sorted by the cell they're in
+
+	grid     *grid             // grid shape, obstacles + the worker pool loops are split across
+	pressure PressureSolver[T] // solves for the pressure in project
+	opts     Options           // solver settings
+
+	pressureStats SolveStats // how the last pressure solve converged
+}
+
+// particle positions are in cells (cell centres are whole numbers, like in advect)
+type particle[T Float] struct {
+	x, y   T
+	vx, vy T
+}
+
+const FLIP_PARTICLES int = 2      // particles per cell along each axis
+const FLIP_RATIO float32 = 0.95   // FLIP part of the particle velocity of the "flip" backend
+
+
+//
+// flipCube functions
+//
+
+func flipCubeCreate[T Float](width, height int, viscosity, dt float32, threads int, opts Options) *flipCube[T] {
+	cube := &flipCube[T]{}
+	size := width * height
+
+	// the particles clump together wherever the projection leaves some divergence
+	// behind, so by default they get the 2D stencil + the most accurate solver
+	if opts.Physics == "" { opts.Physics = "validated" }
+	if opts.Solver == "" { opts.Solver = "multigrid" }
+
+	cube.width = width
+	cube.height = height
+	cube.dt = T(dt)
+	cube.maxDt = T(dt)
+	cube.visc = T(viscosity)
+	cube.opts = opts
+	if opts.Backend == "flip" {
+		cube.ratio = T(FLIP_RATIO)
+	}
+
+	solid, err := solidMask(width, height, opts.Mask, opts.Obstacles); if err != nil {
+		panic(err)
+	}
+	cube.grid = gridCreate(width, height, workerPoolCreate(threads), solid, opts.Boundary)
+	cube.pressure = pressureSolverCreate[T](opts.Solver, cube.grid, opts.RedBlack)
+
+	cube.Vx = make([]T, size)
+	cube.Vy = make([]T, size)
+	cube.Vx0 = make([]T, size)
+	cube.Vy0 = make([]T, size)
+	cube.savedVx = make([]T, size)
+	cube.savedVy = make([]T, size)
+
+	fieldCount := 1 + len(opts.Dyes)
+	if opts.Temperature {
+		fieldCount++
+	}
+	for f:=0; f<fieldCount; f++ {
+		cube.fields = append(cube.fields, make([]T, size))
+		cube.saved = append(cube.saved, make([]T, size))
+	}
+	cube.density = cube.fields[0]
+	cube.dyes = cube.fields[1:1 + len(opts.Dyes)]
+	if opts.Temperature {
+		cube.temperature = cube.fields[fieldCount-1]
+	}
+
+	if opts.Vorticity > 0 {
+		cube.curl = make([]T, size)
+	}
+
+	// evenly spaced particles in every fluid cell
+	for j:=1; j<height-1; j++ {
+		for i:=1; i<width-1; i++ {
+			if !cube.grid.fluid(ix(i, j, width)) {
+				continue
+			}
+			for b:=0; b<FLIP_PARTICLES; b++ {
+				for a:=0; a<FLIP_PARTICLES; a++ {
+					x := T(i) - 0.5 + (T(a) + 0.5) / T(FLIP_PARTICLES)
+					y := T(j) - 0.5 + (T(b) + 0.5) / T(FLIP_PARTICLES)
+					cube.particles = append(cube.particles, particle[T]{x: x, y: y})
+				}
+			}
+		}
+	}
+	for f:=0; f<fieldCount; f++ {
+		cube.values = append(cube.values, make([]T, len(cube.particles)))
+	}
+	if opts.Temperature {
+		for p := range cube.values[fieldCount-1] {
+			cube.values[fieldCount-1][p] = T(opts.AmbientTemperature)
+		}
+	}
+	cube.cellStart = make([]int, size + 1)
+	cube.cellNext = make([]int, size + 1)
+	cube.order = make([]int, len(cube.particles))
+
+	cube.toGrid()
+	return cube
+}
+
+func (cube *flipCube[T]) Step() {
+	if cube.opts.AdaptiveDt {
+		cube.dt = cfl_timestep(cube.Vx, cube.Vy, cube.maxDt, T(cube.opts.CFL), cube.grid)
+	}
+
+	g 	 	:= cube.grid
+	dt 		:= cube.dt
+	Vx 		:= cube.Vx
+	Vy 		:= cube.Vy
+	Vx0 	:= cube.Vx0
+	Vy0 	:= cube.Vy0
+	opts 	:= &cube.opts
+	tol 	:= T(opts.Tolerance)
+	st 		:= T(opts.stencil())
+
+	if opts.Vorticity > 0 {
+		vorticity_confinement(Vx, Vy, cube.curl, T(opts.Vorticity), dt, g)
+	}
+	if opts.Temperature {
+		buoyancy(Vy, cube.density, cube.temperature, T(opts.AmbientTemperature), T(opts.Lift), T(opts.Weight), dt, g)
+	}
+
+	if cube.visc > 0 {
+		diffuse(1, Vx0, Vx, cube.visc, dt, opts.DiffuseIterations, g, opts.RedBlack, tol, st)
+		diffuse(2, Vy0, Vy, cube.visc, dt, opts.DiffuseIterations, g, opts.RedBlack, tol, st)
+		copy(Vx, Vx0)
+		copy(Vy, Vy0)
+	}
+	cube.pressureStats = project(Vx, Vy, Vx0, Vy0, opts.PressureIterations, g, cube.pressure, tol, st)
+
+	// the particles pick the decay up with the rest of the grid's change
+	dissipate(opts, cube.density, cube.dyes, Vx, Vy, g)
+
+	cube.toParticles()
+	cube.move()
+	cube.toGrid()
+}
+
+// Grid to particles. The saved grid arrays are turned into the change since the
+// last toGrid, which is what FLIP adds to the particles.
+func (cube *flipCube[T]) toParticles() {
+	g := cube.grid
+	W := g.W
+	ratio := cube.ratio
+
+	for index := range cube.Vx {
+		cube.savedVx[index] = cube.Vx[index] - cube.savedVx[index]
+		cube.savedVy[index] = cube.Vy[index] - cube.savedVy[index]
+	}
+	for f, field := range cube.fields {
+		saved := cube.saved[f]
+		for index := range field {
+			saved[index] = field[index] - saved[index]
+		}
+	}
+
+	g.pool.forRows(0, len(cube.particles), func(start, end int) {
+		for p:=start; p<end; p++ {
+			particle := &cube.particles[p]
+			x, y := particle.x, particle.y
+
+			pic := interpolate(cube.Vx, x, y, W)
+			flip := particle.vx + interpolate(cube.savedVx, x, y, W)
+			particle.vx = ratio * flip + (1 - ratio) * pic
+
+			pic = interpolate(cube.Vy, x, y, W)
+			flip = particle.vy + interpolate(cube.savedVy, x, y, W)
+			particle.vy = ratio * flip + (1 - ratio) * pic
+
+			for f := range cube.fields {
+				cube.values[f][p] += interpolate(cube.saved[f], x, y, W)
+			}
+		}
+	})
+}
+
+// Moves the particles through the grid velocity with a midpoint (RK2) step. A
+// particle that would end up inside an obstacle stays where it is.
+func (cube *flipCube[T]) move() {
+	g := cube.grid
+	W := g.W
+	dtN := cube.dt * T(g.N-2)
+
+	g.pool.forRows(0, len(cube.particles), func(start, end int) {
+		for p:=start; p<end; p++ {
+			particle := &cube.particles[p]
+			x, y := particle.x, particle.y
+
+			midX, midY := cube.clamp(
+				x + 0.5 * dtN * interpolate(cube.Vx, x, y, W),
+				y + 0.5 * dtN * interpolate(cube.Vy, x, y, W))
+			newX, newY := cube.clamp(
+				x + dtN * interpolate(cube.Vx, midX, midY, W),
+				y + dtN * interpolate(cube.Vy, midX, midY, W))
+
+			if g.fluid(cube.cell(newX, newY)) {
+				particle.x, particle.y = newX, newY
+			}
+		}
+	})
+}
+
+// Particles to grid. Every cell gets the average of the particles around it,
+// weighted by the same bilinear weights interpolate uses. Cells without particles
+// are left empty.
+func (cube *flipCube[T]) toGrid() {
+	g := cube.grid
+	W, H := g.W, g.H
+	periodicX, periodicY := g.bnd.periodicX(), g.bnd.periodicY()
+
+	// counting sort of the particles by cell, a particle is at most half a cell
+	// away from its cell so only the 3x3 cells around a cell can reach it
+	cellStart := cube.cellStart
+	for index := range cellStart {
+		cellStart[index] = 0
+	}
+	for _, particle := range cube.particles {
+		cellStart[cube.cell(particle.x, particle.y) + 1]++
+	}
+	for index:=1; index<len(cellStart); index++ {
+		cellStart[index] += cellStart[index-1]
+	}
+	next := cube.cellNext
+	copy(next, cellStart)
+	for p, particle := range cube.particles {
+		cell := cube.cell(particle.x, particle.y)
+		cube.order[next[cell]] = p
+		next[cell]++
+	}
+
+	g.pool.forRows(1, H-1, func(start, end int) {
+		sums := make([]T, len(cube.fields))
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				var weight, vx, vy T
+				for f := range sums {
+					sums[f] = 0
+				}
+
+				for nj:=j-1; nj<=j+1; nj++ {
+					cj, offsetY := neighbour_cell[T](nj, H, periodicY)
+					for ni:=i-1; ni<=i+1; ni++ {
+						ci, offsetX := neighbour_cell[T](ni, W, periodicX)
+						if ci < 0 || cj < 0 {
+							continue
+						}
+						cell := ix(ci, cj, W)
+						for _, p := range cube.order[cellStart[cell]:cellStart[cell+1]] {
+							particle := &cube.particles[p]
+							wx := 1 - abs(particle.x + offsetX - T(i))
+							wy := 1 - abs(particle.y + offsetY - T(j))
+							if wx <= 0 || wy <= 0 {
+								continue
+							}
+							w := wx * wy
+							weight += w
+							vx += w * particle.vx
+							vy += w * particle.vy
+							for f := range sums {
+								sums[f] += w * cube.values[f][p]
+							}
+						}
+					}
+				}
+
+				if weight > 0 {
+					vx, vy = vx / weight, vy / weight
+					for f := range sums {
+						sums[f] /= weight
+					}
+				}
+				cube.Vx[index], cube.Vy[index] = vx, vy
+				for f, field := range cube.fields {
+					field[index] = sums[f]
+				}
+			}
+		}
+	})
+
+	set_bnd(1, cube.Vx, g)
+	set_bnd(2, cube.Vy, g)
+	for _, field := range cube.fields {
+		set_bnd(0, field, g)
+	}
+
+	copy(cube.savedVx, cube.Vx)
+	copy(cube.savedVy, cube.Vy)
+	for f, field := range cube.fields {
+		copy(cube.saved[f], field)
+	}
+}
+
+// Keeps a particle position inside the interior cells, periodic axes wrap around to
+// the half cell before the first interior cell instead
+func (cube *flipCube[T]) clamp(x, y T) (T, T) {
+	g := cube.grid
+	Wfloat, Hfloat := T(g.W), T(g.H)
+	if g.bnd.periodicX() {
+		x = wrap(x, Wfloat)
+		if x >= Wfloat - 1.5 { x -= Wfloat - 2 }
+	} else {
+		if !(x >= 1) { x = 1 }
+		if x > Wfloat - 2 { x = Wfloat - 2 }
+	}
+	if g.bnd.periodicY() {
+		y = wrap(y, Hfloat)
+		if y >= Hfloat - 1.5 { y -= Hfloat - 2 }
+	} else {
+		if !(y >= 1) { y = 1 }
+		if y > Hfloat - 2 { y = Hfloat - 2 }
+	}
+	return x, y
+}
+
+// index of the cell whose centre is closest to the position
+func (cube *flipCube[T]) cell(x, y T) int {
+	return ix(int(floorf(x + 0.5)), int(floorf(y + 0.5)), cube.width)
+}
+
+func (cube *flipCube[T]) Dt() float32 {
+	return float32(cube.dt)
+}
+
+// stops the cube's worker pool, the cube can't be stepped afterwards
+func (cube *flipCube[T]) Close() {
+	cube.grid.pool.Close()
+}
+
+func (cube *flipCube[T]) Width() int {
+	return cube.width
+}
+
+func (cube *flipCube[T]) Height() int {
+	return cube.height
+}
+
+func (cube *flipCube[T]) AddDensity(x, y int, amount float32) {
+	W := cube.width
+	cube.density[ix(x, y, W)] += T(amount)
+}
+
+func (cube *flipCube[T]) AddVelocity(x, y int, amountX, amountY float32) {
+	W := cube.width
+	index := ix(x, y, W)
+
+	cube.Vx[index] += T(amountX)
+	cube.Vy[index] += T(amountY)
+}
+
+// does nothing if the temperature field is disabled
+func (cube *flipCube[T]) AddTemperature(x, y int, amount float32) {
+	if cube.temperature == nil {
+		return
+	}
+	W := cube.width
+	cube.temperature[ix(x, y, W)] += T(amount)
+}
+
+func (cube *flipCube[T]) Temperature(x, y int) float32 {
+	if cube.temperature == nil {
+		return cube.opts.AmbientTemperature
+	}
+	W := cube.width
+	return float32(cube.temperature[ix(x, y, W)])
+}
+
+func (cube *flipCube[T]) Density(x, y int) float32 {
+	W := cube.width
+	return float32(cube.density[ix(x, y, W)])
+}
+
+func (cube *flipCube[T]) AddDye(channel, x, y int, amount float32) {
+	W := cube.width
+	cube.dyes[channel][ix(x, y, W)] += T(amount)
+}
+
+func (cube *flipCube[T]) Dye(channel, x, y int) float32 {
+	W := cube.width
+	return float32(cube.dyes[channel][ix(x, y, W)])
+}
+
+// number of dye channels
+func (cube *flipCube[T]) DyeCount() int {
+	return len(cube.dyes)
+}
+
+// true if the cell is part of an obstacle
+func (cube *flipCube[T]) Solid(x, y int) bool {
+	return !cube.grid.fluid(ix(x, y, cube.width))
+}
+
+func (cube *flipCube[T]) Velocity(x, y int) (float32, float32) {
+	W := cube.width
+	return float32(cube.Vx[ix(x, y, W)]), float32(cube.Vy[ix(x, y, W)])
+}
+
+// always zero, the particles aren't diffused
+func (cube *flipCube[T]) DiffuseStats() SolveStats {
+	return SolveStats{}
+}
+
+// iterations + residual of the pressure solve in the last Step
+func (cube *flipCube[T]) PressureStats() SolveStats {
+	return cube.pressureStats
+}
+
+func (cube *flipCube[T]) diagnose() Diagnostics {
+	return diagnose(cube.grid, cube.density, cube.dyes, cube.Vx, cube.Vy)
+}
+
+
+//
+// Helper functions
+//
+
+// Bilinear interpolation of d at a position between the cell centres (x, y),
+// which has to be at least half a cell inside the grid
+func interpolate[T Float](d []T, x, y T, W int) T {
+	i0, j0 := floorf(x), floorf(y)
+	s1, t1 := x - i0, y - j0
+	s0, t0 := 1 - s1, 1 - t1
+	i, j := int(i0), int(j0)
+	return s0 * (t0 * d[ix(i, j, W)] + t1 * d[ix(i, j+1, W)]) +
+		s1 * (t0 * d[ix(i+1, j, W)] + t1 * d[ix(i+1, j+1, W)])
+}
+
+// Interior cell whose particles are splatted into the neighbour i of a cell, and
+// what to add to their position. On periodic axes the boundary cells are the
+// interior cells on the other side, otherwise they have no particles (-1).
+func neighbour_cell[T Float](i, N int, periodic bool) (int, T) {
+	if i >= 1 && i <= N-2 {
+		return i, 0
+	}
+	if !periodic {
+		return -1, 0
+	}
+	if i < 1 {
+		return i + N - 2, -T(N - 2)
+	}
+	return i - (N - 2), T(N - 2)
+}
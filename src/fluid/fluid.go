@@ -5,20 +5,84 @@ import (
 	"math"
 )
 
+// FluidCube is the 2D fluid simulation. It's run by the stable fluids solver in this
+// file, the lattice Boltzmann one in lbm.go or the particle one in flip.go
+// (Options.Backend). Their arrays are float32 or float64 depending on
+// Options.Precision, the methods always take and return float32.
 type FluidCube struct {
-	size 	int		// length of cube sides
-	dt 	 	float32 // length of the timestep
-	diff 	float32 // diffusion (how fast stuff spreads out in the fluid)
-	visc 	float32 // viscosity (how thick the fluid is)
+	cubeBackend
+	diagnostics Diagnostics // measured the first time they're asked for after a Step
+	measured    bool        // false until diagnostics match the current Step
+}
+
+// Float is the precision the fluid cube's arrays + solvers are computed in
+type Float interface {
+	~float32 | ~float64
+}
+
+// what Simulation needs from a 2D solver, independent of its precision
+type cubeBackend interface {
+	Step()
+	Dt() float32
+	Close()
+	Width() int
+	Height() int
+	AddDensity(x, y int, amount float32)
+	AddVelocity(x, y int, amountX, amountY float32)
+	AddTemperature(x, y int, amount float32)
+	AddDye(channel, x, y int, amount float32)
+	Density(x, y int) float32
+	Velocity(x, y int) (float32, float32)
+	Temperature(x, y int) float32
+	Dye(channel, x, y int) float32
+	DyeCount() int
+	Solid(x, y int) bool
+	DiffuseStats() SolveStats
+	PressureStats() SolveStats
+	diagnose() Diagnostics
+}
+
+type fluidCube[T Float] struct {
+	width 	int	// cells across, including the boundary cells
+	height 	int	// cells down, including the boundary cells
+	dt 	 	T 	// length of the timestep (chosen every tick in adaptive mode)
+	maxDt 	T 	// fixed timestep, the upper bound of dt in adaptive mode
+	diff 	T 	// diffusion (how fast stuff spreads out in the fluid)
+	visc 	T 	// viscosity (how thick the fluid is)
+
+	s 		[]T   // scratch space density array
+	density []T   // density array
+	dyes 	[][]T // extra dye channels (see Options.Dyes)
+
+	Vx 		[]T // velocity array
+	Vy 		[]T // velocity array
 
-	s 		[]float32 // scratch space density array
-	density []float32 // density array
+	Vx0 	[]T // scratch space velocity array (need old values while computing new ones)
+	Vy0 	[]T // scratch space velocity array (need old values while computing new ones)
 
-	Vx 		[]float32 // velocity array
-	Vy 		[]float32 // velocity array
+	curl 	[]T // scratch space for vorticity confinement (nil if disabled)
 
-	Vx0 	[]float32 // scratch space velocity array (need old values while computing new ones)
-	Vy0 	[]float32 // scratch space velocity array (need old values while computing new ones)
+	advect0 []T // scratch space for maccormack + bfecc advection (nil otherwise)
+	advect1 []T // scratch space for maccormack + bfecc advection (nil otherwise)
+
+	temperature  []T // temperature array (nil if disabled)
+	temperature0 []T // scratch space temperature array
+
+	reaction0 []T // scratch space for the reaction's first species (nil if disabled)
+	reaction1 []T // scratch space for the reaction's second species (nil if disabled)
+
+	grid     *grid             // grid shape, obstacles + the worker pool the row loops are split across
+	pressure PressureSolver[T] // solves for the pressure in project
+	opts     Options           // solver settings
+
+	diffuseStats  SolveStats // how the last density diffusion converged
+	pressureStats SolveStats // how the last pressure solve converged
+}
+
+// SolveStats describes how far a linear solve got
+type SolveStats struct {
+	Iterations int     // iterations that were run (fewer than requested if the tolerance was reached)
+	Residual   float32 // root mean square residual over the interior cells after the solve
 }
 
 
@@ -26,29 +90,113 @@ type FluidCube struct {
 // FluidCube functions
 //
 
-func FluidCubeCreate(size int, diffusion, viscosity, dt float32) *FluidCube {
-	cube := &FluidCube{}
-	N := size
+func FluidCubeCreate(width, height int, diffusion, viscosity, dt float32, threads int, opts Options) *FluidCube {
+	opts.initialize()
+	float64s := opts.Precision == "float64"
+
+	var backend cubeBackend
+	switch {
+	case opts.Backend == "lbm" && float64s:
+		backend = lbmCubeCreate[float64](width, height, diffusion, viscosity, dt, threads, opts)
+	case opts.Backend == "lbm":
+		backend = lbmCubeCreate[float32](width, height, diffusion, viscosity, dt, threads, opts)
+	case (opts.Backend == "flip" || opts.Backend == "pic") && float64s:
+		backend = flipCubeCreate[float64](width, height, viscosity, dt, threads, opts)
+	case opts.Backend == "flip" || opts.Backend == "pic":
+		backend = flipCubeCreate[float32](width, height, viscosity, dt, threads, opts)
+	case float64s:
+		backend = fluidCubeCreate[float64](width, height, diffusion, viscosity, dt, threads, opts)
+	default:
+		backend = fluidCubeCreate[float32](width, height, diffusion, viscosity, dt, threads, opts)
+	}
+
+	cube := &FluidCube{cubeBackend: backend}
+	err := loadInitialState(cube, &opts); if err != nil {
+		panic(err)
+	}
+	return cube
+}
+
+// steps the backend, the diagnostics are only measured again if they're asked for
+func (cube *FluidCube) Step() {
+	cube.cubeBackend.Step()
+	cube.measured = false
+}
+
+// diagnostics of the cube after the last Step
+func (cube *FluidCube) Diagnostics() Diagnostics {
+	if !cube.measured {
+		cube.diagnostics = cube.diagnose()
+		cube.measured = true
+	}
+	return cube.diagnostics
+}
+
+func fluidCubeCreate[T Float](width, height int, diffusion, viscosity, dt float32, threads int, opts Options) *fluidCube[T] {
+	cube := &fluidCube[T]{}
+	size := width * height
+
+	cube.width = width
+	cube.height = height
+	cube.dt = T(dt)
+	cube.maxDt = T(dt)
+	cube.diff = T(diffusion)
+	cube.visc = T(viscosity)
+	cube.opts = opts
+
+	solid, err := solidMask(width, height, opts.Mask, opts.Obstacles); if err != nil {
+		panic(err)
+	}
+	cube.grid = gridCreate(width, height, workerPoolCreate(threads), solid, opts.Boundary)
+	cube.pressure = pressureSolverCreate[T](opts.Solver, cube.grid, opts.RedBlack)
+
+	cube.s = make([]T, size)	
+	cube.density = make([]T, size)
+	for range opts.Dyes {
+		cube.dyes = append(cube.dyes, make([]T, size))
+	}
+
+	cube.Vx = make([]T, size)
+	cube.Vy = make([]T, size)
 
-	cube.size = size
-	cube.dt = dt
-	cube.diff = diffusion
-	cube.visc = viscosity
+	cube.Vx0 = make([]T, size)
+	cube.Vy0 = make([]T, size)
 
-	cube.s = make([]float32, N*N)	
-	cube.density = make([]float32, N*N)
+	if opts.Vorticity > 0 {
+		cube.curl = make([]T, size)
+	}
 
-	cube.Vx = make([]float32, N*N)
-	cube.Vy = make([]float32, N*N)
+	if opts.Advection == "maccormack" || opts.Advection == "bfecc" {
+		cube.advect0 = make([]T, size)
+		cube.advect1 = make([]T, size)
+	}
 
-	cube.Vx0 = make([]float32, N*N)
-	cube.Vy0 = make([]float32, N*N)
+	if opts.Temperature {
+		cube.temperature = make([]T, size)
+		cube.temperature0 = make([]T, size)
+		for index := range cube.temperature {
+			cube.temperature[index] = T(opts.AmbientTemperature)
+		}
+	}
+
+	// the reaction starts with u everywhere and no v
+	if opts.Reaction {
+		cube.reaction0 = make([]T, size)
+		cube.reaction1 = make([]T, size)
+		for index := range cube.dyes[0] {
+			cube.dyes[0][index] = 1
+		}
+	}
 
 	return cube
 }
 
-func (cube *FluidCube) Step() {
-	N 	 	:= cube.size;
+func (cube *fluidCube[T]) Step() {
+	if cube.opts.AdaptiveDt {
+		cube.dt = cube.cflTimestep()
+	}
+
+	g 	 	:= cube.grid;
 	visc 	:= cube.visc
 	diff 	:= cube.diff
 	dt 		:= cube.dt
@@ -58,42 +206,158 @@ func (cube *FluidCube) Step() {
 	Vy0 	:= cube.Vy0
 	s 		:= cube.s
 	density := cube.density
+	solver 	:= cube.pressure
+	opts 	:= &cube.opts
+	dIter 	:= opts.DiffuseIterations
+	pIter 	:= opts.PressureIterations
+	rb 		:= opts.RedBlack
+	tol 	:= T(opts.Tolerance)
+	st 		:= T(opts.stencil())
+
+	if opts.Vorticity > 0 {
+		vorticity_confinement(Vx, Vy, cube.curl, T(opts.Vorticity), dt, g)
+	}
+	if opts.Temperature {
+		buoyancy(Vy, density, cube.temperature, T(opts.AmbientTemperature), T(opts.Lift), T(opts.Weight), dt, g)
+	}
     
-    diffuse(1, Vx0, Vx, visc, dt, 4, N);
-    diffuse(2, Vy0, Vy, visc, dt, 4, N);
+    diffuse(1, Vx0, Vx, visc, dt, dIter, g, rb, tol, st);
+    diffuse(2, Vy0, Vy, visc, dt, dIter, g, rb, tol, st);
     
-    project(Vx0, Vy0, Vx, Vy, 4, N);
+    project(Vx0, Vy0, Vx, Vy, pIter, g, solver, tol, st);
     
-    advect(1, Vx, Vx0, Vx0, Vy0, dt, N);
-    advect(2, Vy, Vy0, Vx0, Vy0, dt, N);
+    cube.advectField(1, Vx, Vx0, Vx0, Vy0, dt);
+    cube.advectField(2, Vy, Vy0, Vx0, Vy0, dt);
     
-    project(Vx, Vy, Vx0, Vy0, 4, N);
+    cube.pressureStats = project(Vx, Vy, Vx0, Vy0, pIter, g, solver, tol, st);
     
-    diffuse(0, s, density, diff, dt, 4, N);
-    advect(0, density, s, Vx, Vy, dt, N);
+    cube.diffuseStats = diffuse(0, s, density, diff, dt, dIter, g, rb, tol, st);
+    cube.advectField(0, density, s, Vx, Vy, dt);
+
+	for channel, dye := range cube.dyes {
+		if opts.Reaction && channel < 2 {
+			continue
+		}
+		dyeDiff := T(opts.Dyes[channel].Diffusion)
+		if dyeDiff == 0 {
+			dyeDiff = diff
+		}
+		diffuse(0, s, dye, dyeDiff, dt, dIter, g, rb, tol, st)
+		cube.advectField(0, dye, s, Vx, Vy, dt)
+	}
+
+	if opts.Temperature {
+		temp, temp0 := cube.temperature, cube.temperature0
+		diffuse(0, temp0, temp, T(opts.TemperatureDiffusion), dt, dIter, g, rb, tol, st)
+		cube.advectField(0, temp, temp0, Vx, Vy, dt)
+	}
+
+	dissipate(opts, density, cube.dyes, Vx, Vy, g)
+
+	if opts.Reaction {
+		cube.react()
+	}
+}
+
+// advects with the scheme selected in the options
+func (cube *fluidCube[T]) advectField(b int, d, d0, velocX, velocY []T, dt T) {
+	advect_scheme(cube.opts.Advection, b, d, d0, velocX, velocY, dt, cube.grid, cube.advect0, cube.advect1)
+}
+
+func (cube *fluidCube[T]) cflTimestep() T {
+	return cfl_timestep(cube.Vx, cube.Vy, cube.maxDt, T(cube.opts.CFL), cube.grid)
+}
+
+// timestep used by the last Step
+func (cube *fluidCube[T]) Dt() float32 {
+	return float32(cube.dt)
+}
+
+// stops the cube's worker pool, the cube can't be stepped afterwards
+func (cube *fluidCube[T]) Close() {
+	cube.grid.pool.Close()
 }
 
-func (cube *FluidCube) AddDensity(x, y int, amount float32) {
-	N := cube.size
-	cube.density[ix(x, y, N)] += amount
+func (cube *fluidCube[T]) Width() int {
+	return cube.width
 }
 
-func (cube *FluidCube) AddVelocity(x, y int, amountX, amountY float32) {
-	N := cube.size
-	index := ix(x, y, N)
+func (cube *fluidCube[T]) Height() int {
+	return cube.height
+}
 
-	cube.Vx[index] += amountX
-	cube.Vy[index] += amountY
+func (cube *fluidCube[T]) AddDensity(x, y int, amount float32) {
+	W := cube.width
+	cube.density[ix(x, y, W)] += T(amount)
 }
 
-func (cube *FluidCube) Density(x, y int) float32 {
-	N := cube.size
-	return cube.density[ix(x, y, N)]
+func (cube *fluidCube[T]) AddVelocity(x, y int, amountX, amountY float32) {
+	W := cube.width
+	index := ix(x, y, W)
+
+	cube.Vx[index] += T(amountX)
+	cube.Vy[index] += T(amountY)
 }
 
-func (cube *FluidCube) Velocity(x, y int) (float32, float32) {
-	N := cube.size
-	return cube.Vx[ix(x, y, N)], cube.Vy[ix(x, y, N)]
+// does nothing if the temperature field is disabled
+func (cube *fluidCube[T]) AddTemperature(x, y int, amount float32) {
+	if cube.temperature == nil {
+		return
+	}
+	W := cube.width
+	cube.temperature[ix(x, y, W)] += T(amount)
+}
+
+func (cube *fluidCube[T]) Temperature(x, y int) float32 {
+	if cube.temperature == nil {
+		return cube.opts.AmbientTemperature
+	}
+	W := cube.width
+	return float32(cube.temperature[ix(x, y, W)])
+}
+
+func (cube *fluidCube[T]) Density(x, y int) float32 {
+	W := cube.width
+	return float32(cube.density[ix(x, y, W)])
+}
+
+func (cube *fluidCube[T]) AddDye(channel, x, y int, amount float32) {
+	W := cube.width
+	cube.dyes[channel][ix(x, y, W)] += T(amount)
+}
+
+func (cube *fluidCube[T]) Dye(channel, x, y int) float32 {
+	W := cube.width
+	return float32(cube.dyes[channel][ix(x, y, W)])
+}
+
+// number of dye channels
+func (cube *fluidCube[T]) DyeCount() int {
+	return len(cube.dyes)
+}
+
+// true if the cell is part of an obstacle
+func (cube *fluidCube[T]) Solid(x, y int) bool {
+	return !cube.grid.fluid(ix(x, y, cube.width))
+}
+
+func (cube *fluidCube[T]) Velocity(x, y int) (float32, float32) {
+	W := cube.width
+	return float32(cube.Vx[ix(x, y, W)]), float32(cube.Vy[ix(x, y, W)])
+}
+
+// iterations + residual of the density diffusion in the last Step
+func (cube *fluidCube[T]) DiffuseStats() SolveStats {
+	return cube.diffuseStats
+}
+
+// iterations + residual of the final pressure solve in the last Step
+func (cube *fluidCube[T]) PressureStats() SolveStats {
+	return cube.pressureStats
+}
+
+func (cube *fluidCube[T]) diagnose() Diagnostics {
+	return diagnose(cube.grid, cube.density, cube.dyes, cube.Vx, cube.Vy)
 }
 
 
@@ -101,134 +365,260 @@ func (cube *FluidCube) Velocity(x, y int) (float32, float32) {
 // Helper functions
 //
 
-func ix(x, y, N int) int {
-	return x + y * N
+func ix(x, y, width int) int {
+	return x + y * width
 }
 
-func set_bnd(b int, x []float32, N int) {
-	for j:=1; j<N-1; j++ {
-		if b == 2 {
-			x[ix(j, 0, N)] = -x[ix(j, 1, N)]
-			x[ix(j, N-1, N)] = -x[ix(j, N-2, N)]
+// b is 0 for scalars, 1/2 for the x/y velocity and 3 for the pressure, see
+// edge_value for how each kind of edge treats them
+func set_bnd[T Float](b int, x []T, g *grid) {
+	W, H := g.W, g.H
+
+	// Obstacles are set first so the outer walls see their final values. Scalars
+	// copy the average of the neighbouring fluid, velocities are mirrored so they
+	// vanish on the obstacle's surface (no-slip).
+	for _, cell := range g.obstacles {
+		var avg T
+		for _, n := range cell.neighbours {
+			avg += x[n]
+		}
+		if len(cell.neighbours) > 0 {
+			avg /= T(len(cell.neighbours))
+		}
+		if b == 1 || b == 2 {
+			x[cell.index] = -avg
 		} else {
-			x[ix(j, 0, N)] = x[ix(j, 1, N)]
-			x[ix(j, N-1, N)] = x[ix(j, N-2, N)]
+			x[cell.index] = avg
 		}
 	}
 
-	for k:=1; k<N-1; k++ {
-		if b == 1 {
-			x[ix(0, k, N)] = -x[ix(1, k, N)]
-			x[ix(N-1, k, N)] = -x[ix(N-2, k, N)]
-		} else {
-			x[ix(0, k, N)] = x[ix(1, k, N)]
-			x[ix(N-1, k, N)] = x[ix(N-2, k, N)]
-		}
+	bnd := &g.bnd
+	for j:=1; j<W-1; j++ {
+		top, bottom := x[ix(j, 1, W)], x[ix(j, H-2, W)]
+		x[ix(j, 0, W)] = edge_value(b, 2, &bnd.Top, top, bottom)
+		x[ix(j, H-1, W)] = edge_value(b, 2, &bnd.Bottom, bottom, top)
+	}
+
+	for k:=1; k<H-1; k++ {
+		left, right := x[ix(1, k, W)], x[ix(W-2, k, W)]
+		x[ix(0, k, W)] = edge_value(b, 1, &bnd.Left, left, right)
+		x[ix(W-1, k, W)] = edge_value(b, 1, &bnd.Right, right, left)
 	}
 
-	x[ix(0, 0, N)] 	   = 0.5 * (x[ix(1, 0, N)] + x[ix(0, 1, N)]);
-	x[ix(0, N-1, N)]   = 0.5 * (x[ix(1, N-1, N)] + x[ix(0, N-2, N)]);
-	x[ix(N-1, 0, N)]   = 0.5 * (x[ix(N-2, 0, N)] + x[ix(N-1, 1, N)]);
-	x[ix(N-1, N-1, N)] = 0.5 * (x[ix(N-2, N-1, N)] + x[ix(N-1, N-2, N)]);
+	x[ix(0, 0, W)] 	   = 0.5 * (x[ix(1, 0, W)] + x[ix(0, 1, W)]);
+	x[ix(0, H-1, W)]   = 0.5 * (x[ix(1, H-1, W)] + x[ix(0, H-2, W)]);
+	x[ix(W-1, 0, W)]   = 0.5 * (x[ix(W-2, 0, W)] + x[ix(W-1, 1, W)]);
+	x[ix(W-1, H-1, W)] = 0.5 * (x[ix(W-2, H-1, W)] + x[ix(W-1, H-2, W)]);
 }
 
-func lin_solve(b int, x, x0 []float32, a, c float32, iter, N int) {
+// Runs up to iter iterations, if tolerance > 0 it stops as soon as the residual drops
+// below it. If redBlack is set the red-black ordered solver is used instead of the
+// sequential sweep. Obstacle cells are skipped, set_bnd fills them in.
+func lin_solve[T Float](b int, x, x0 []T, a, c T, iter int, g *grid, redBlack bool, tolerance T) SolveStats {
+	W, H := g.W, g.H
 	cRecip := 1.0/c
 	for k:=0; k<iter; k++ {
-		for m:= 1; m<N-1; m++ {
-			for j:=1; j<N-1; j++ {
-				x[ix(j, m, N)] =
-					(x0[ix(j, m, N)] +
-						a * (x[ix(j+1, m, N)] +
-							 x[ix(j-1, m, N)] +
-							 x[ix(j, m+1, N)] +
-							 x[ix(j, m-1, N)])) * cRecip
+		if redBlack {
+			lin_solve_rb(b, x, x0, a, c, 1, g)
+		} else {
+			for m:= 1; m<H-1; m++ {
+				for j:=1; j<W-1; j++ {
+					if !g.fluid(ix(j, m, W)) {
+						continue
+					}
+					x[ix(j, m, W)] =
+						(x0[ix(j, m, W)] +
+							a * (x[ix(j+1, m, W)] +
+								 x[ix(j-1, m, W)] +
+								 x[ix(j, m+1, W)] +
+								 x[ix(j, m-1, W)])) * cRecip
+				}
+			}
+			set_bnd(b, x, g)
+		}
+
+		if tolerance > 0 {
+			r := residual(x, x0, a, c, g)
+			if r < tolerance {
+				return SolveStats{k+1, float32(r)}
 			}
 		}
-		set_bnd(b, x, N)
 	}
+	return SolveStats{iter, float32(residual(x, x0, a, c, g))}
 }
 
-func diffuse(b int, x, x0 []float32, diff, dt float32, iter, N int) {
-	a := dt * diff * float32(N-2) * float32(N-2)
-	lin_solve(b, x, x0, a, 1 + 6 * a, iter, N)
+// Red-black (checkerboard) Gauss-Seidel. Each "red" cell (i+j even) only depends
+// on its "black" neighbours and vice versa, so every half sweep can be split into
+// row bands which are solved by the worker pool without any data races. The result
+// differs slightly from the sequential sweep because the update order changes.
+func lin_solve_rb[T Float](b int, x, x0 []T, a, c T, iter int, g *grid) {
+	W, H := g.W, g.H
+	cRecip := 1.0/c
+	for k:=0; k<iter; k++ {
+		for colour:=0; colour<2; colour++ {
+			g.pool.forRows(1, H-1, func(start, end int) {
+				for m:=start; m<end; m++ {
+					// first interior cell in this row with the current colour
+					for j:=1+(m+colour+1)%2; j<W-1; j+=2 {
+						if !g.fluid(ix(j, m, W)) {
+							continue
+						}
+						x[ix(j, m, W)] =
+							(x0[ix(j, m, W)] +
+								a * (x[ix(j+1, m, W)] +
+									 x[ix(j-1, m, W)] +
+									 x[ix(j, m+1, W)] +
+									 x[ix(j, m-1, W)])) * cRecip
+					}
+				}
+			})
+		}
+		set_bnd(b, x, g)
+	}
 }
 
-func advect(b int, d, d0, velocX, velocY []float32, dt float32, N int) {
-	var i0, i1, j0, j1 float32
-
-	dtx := dt * float32(N-2)
-	dty := dt * float32(N-2)
-
-	var s0, s1, t0, t1 float32
-	var tmp1, tmp2, x, y float32
-
-	Nfloat := float32(N)
-	var ifloat, jfloat float32
-	var i, j int
+// stencil is the number of neighbours in the laplacian (see Options.stencil)
+func diffuse[T Float](b int, x, x0 []T, diff, dt T, iter int, g *grid, redBlack bool, tolerance, stencil T) SolveStats {
+	N := g.N
+	a := dt * diff * T(N-2) * T(N-2)
+	return lin_solve(b, x, x0, a, 1 + stencil * a, iter, g, redBlack, tolerance)
+}
 
-	for j, jfloat = 1, 1.0; j<N-1; j, jfloat = j+1, jfloat+1 {
-		for i, ifloat = 1, 1.0; i<N-1; i, ifloat = i+1, ifloat+1 {
-			tmp1 = dtx * velocX[ix(i, j, N)]
-			tmp2 = dty * velocY[ix(i, j, N)]
-			x = ifloat - tmp1
-			y = jfloat - tmp2
+// Obstacle cells are overwritten by set_bnd at the end, so anything that's traced
+// back into an obstacle picks up the boundary values around it.
+func advect[T Float](b int, d, d0, velocX, velocY []T, dt T, g *grid) {
+	W, H, N := g.W, g.H, g.N
+	dtx := dt * T(N-2)
+	dty := dt * T(N-2)
+
+	Wfloat, Hfloat := T(W), T(H)
+	periodicX, periodicY := g.bnd.periodicX(), g.bnd.periodicY()
+
+	// every cell only reads from d0 and the velocity arrays so rows can be split into bands
+	g.pool.forRows(1, H-1, func(start, end int) {
+		var i0, i1, j0, j1 T
+		var s0, s1, t0, t1 T
+		var tmp1, tmp2, x, y T
+
+		var ifloat, jfloat T
+		var i, j int
+
+		for j, jfloat = start, T(start); j<end; j, jfloat = j+1, jfloat+1 {
+			for i, ifloat = 1, 1.0; i<W-1; i, ifloat = i+1, ifloat+1 {
+				tmp1 = dtx * velocX[ix(i, j, W)]
+				tmp2 = dty * velocY[ix(i, j, W)]
+				x = ifloat - tmp1
+				y = jfloat - tmp2
+
+				// keep the backtraced position inside the grid (i1 can be at most W-1, j1
+				// H-1), periodic axes wrap around instead. NaN fails the comparisons too so
+				// a blown up velocity can't index outside the grid.
+				if periodicX {
+					x = wrap(x, Wfloat)
+				} else {
+					if !(x >= 0.5) { x = 0.5 }
+					if x > Wfloat - 1.5 { x = Wfloat - 1.5 }
+				}
+				i0 = floorf(x)
+				i1 = i0 + 1.0
+				if periodicY {
+					y = wrap(y, Hfloat)
+				} else {
+					if !(y >= 0.5) { y = 0.5 }
+					if y > Hfloat - 1.5 { y = Hfloat - 1.5 }
+				}
+				j0 = floorf(y)
+				j1 = j0 + 1.0
+
+				s1 = x - i0
+				s0 = 1.0 - s1
+				t1 = y - j0
+				t0 = 1.0 - t1
+
+				i0i := int(i0)
+				i1i := int(i1)
+				j0i := int(j0)
+				j1i := int(j1)
+
+				d[ix(i, j, W)] =
+					s0 * (t0 * d0[ix(i0i, j0i, W)] + t1 * d0[ix(i0i, j1i, W)]) +
+					s1 * (t0 * d0[ix(i1i, j0i, W)] + t1 * d0[ix(i1i, j1i, W)])
+			}
+		}
+	})
 
-			if x < 0.5 { x = 0.5 }
-			if x > Nfloat + 0.5 { x = Nfloat + 0.5 }
-			i0 = floorf(x)
-			i1 = i0 + 1.0
-			if y < 0.5 { y = 0.5 }
-			if y > Nfloat + 0.5 { y = Nfloat + 0.5 }
-			j0 = floorf(y)
-			j1 = j0 + 1.0
+	set_bnd(b, d, g)
+}
 
-			s1 = x - i0
-			s0 = 1.0 - s1
-			t1 = y - j0
-			t0 = 1.0 - t1
+// returns how the pressure solve converged
+func project[T Float](velocX, velocY, p, div []T, iter int, g *grid, solver PressureSolver[T], tolerance, stencil T) SolveStats {
+	W, H, N := g.W, g.H, g.N
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				div[ix(i, j, W)] = -0.5*(
+					velocX[ix(i+1, j, W)] -
+					velocX[ix(i-1, j, W)] +
+					velocY[ix(i, j+1, W)] -
+					velocY[ix(i, j-1, W)])/T(N)
+				p[ix(i, j, W)] = 0
+			}
+		}
+	})
 
-			i0i := int(i0)
-			i1i := int(i1)
-			j0i := int(j0)
-			j1i := int(j1)
+	set_bnd(0, div, g)
+	set_bnd(3, p, g)
+	stats := solver.Solve(p, div, 1, stencil, iter, tolerance)
 
-			d[ix(i, j, N)] =
-				s0 * (t0 * d0[ix(i0i, j0i, N)] + t1 * d0[ix(i0i, j1i, N)]) +
-				s1 * (t0 * d0[ix(i1i, j0i, N)] + t1 * d0[ix(i1i, j1i, N)])
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				velocX[ix(i, j, W)] -= 0.5 * (p[ix(i+1, j, W)] - p[ix(i-1, j, W)]) * T(N)
+				velocY[ix(i, j, W)] -= 0.5 * (p[ix(i, j+1, W)] - p[ix(i, j-1, W)]) * T(N)
+			}
 		}
-	}
+	})
 
-	set_bnd(b, d, N)
+	set_bnd(1, velocX, g)
+	set_bnd(2, velocY, g)
+	return stats
 }
 
-func project(velocX, velocY, p, div []float32, iter, N int) {
-	for j:= 1; j<N-1; j++ {
-		for i:=1; i<N-1; i++ {
-			div[ix(i, j, N)] = -0.5*(
-				velocX[ix(i+1, j, N)] -
-				velocX[ix(i-1, j, N)] +
-				velocY[ix(i, j+1, N)] -
-				velocY[ix(i, j-1, N)])/float32(N)
-			p[ix(i, j, N)] = 0
+// Largest timestep (up to maxDt) for which the fastest cell moves at most cfl cells.
+// advect moves a cell by dt * (N-2) * velocity cells (N is the longer side).
+func cfl_timestep[T Float](velocX, velocY []T, maxDt, cfl T, g *grid) T {
+	var maxVelocity T
+	for index := range velocX {
+		v := T(math.Sqrt(float64(velocX[index]*velocX[index] + velocY[index]*velocY[index])))
+		if v > maxVelocity {
+			maxVelocity = v
 		}
 	}
 
-	set_bnd(0, div, N)
-	set_bnd(0, p, N)
-	lin_solve(0, p, div, 1, 6, iter, N)
-
-	for j:= 1; j<N-1; j++ {
-		for i:=1; i<N-1; i++ {
-			velocX[ix(i, j, N)] -= 0.5 * (p[ix(i+1, j, N)] - p[ix(i-1, j, N)]) * float32(N)
-			velocY[ix(i, j, N)] -= 0.5 * (p[ix(i, j+1, N)] - p[ix(i, j-1, N)]) * float32(N)
-		}
+	if maxVelocity == 0 {
+		return maxDt
+	}
+	dt := cfl / (T(g.N-2) * maxVelocity)
+	if dt > maxDt {
+		return maxDt
 	}
+	return dt
+}
 
-	set_bnd(1, velocX, N)
-	set_bnd(2, velocY, N)
+// Moves a position on a periodic axis of length N into [1, N-1), the interior cells
+// plus the boundary cell after them (which set_bnd wrapped around to the first one)
+func wrap[T Float](x, Nfloat T) T {
+	period := Nfloat - 2
+	x = T(math.Mod(float64(x - 1), float64(period)))
+	if x < 0 {
+		x += period
+	}
+	if !(x < period) {
+		x = 0 // rounding, or NaN
+	}
+	return x + 1
 }
 
-func floorf(x float32) float32 {
-	return float32(math.Floor(float64(x)))
+func floorf[T Float](x T) T {
+	return T(math.Floor(float64(x)))
 }
\ No newline at end of file
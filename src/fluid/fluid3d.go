@@ -0,0 +1,356 @@
+// CODE ADAPTED FROM SOURCE: https://mikeash.com/pyblog/fluid-simulation-for-dummies.html
+// (the original 3D version, FluidCube is the 2D port)
+package fluid
+
+import (
+	"math"
+)
+
+// FluidCube3D is an N*N*N cube of fluid. It only supports the basic solver settings
+// (dt, adaptiveDt, cfl, diffuseIterations, pressureIterations, redBlack), the rest
+// of the options are 2D only.
+type FluidCube3D struct {
+	size 	int		// length of cube sides
+	dt 	 	float32 // length of the timestep (chosen every tick in adaptive mode)
+	maxDt 	float32 // fixed timestep, the upper bound of dt in adaptive mode
+	diff 	float32 // diffusion (how fast stuff spreads out in the fluid)
+	visc 	float32 // viscosity (how thick the fluid is)
+
+	s 		[]float32 // scratch space density array
+	density []float32 // density array
+
+	Vx 		[]float32 // velocity array
+	Vy 		[]float32 // velocity array
+	Vz 		[]float32 // velocity array
+
+	Vx0 	[]float32 // scratch space velocity array
+	Vy0 	[]float32 // scratch space velocity array
+	Vz0 	[]float32 // scratch space velocity array
+
+	pool 	*workerPool // goroutines the z slices are split across
+	opts 	Options     // solver settings
+}
+
+
+//
+// FluidCube3D functions
+//
+
+func FluidCube3DCreate(size int, diffusion, viscosity, dt float32, threads int, opts Options) *FluidCube3D {
+	cube := &FluidCube3D{}
+	N := size
+
+	cube.size = size
+	cube.dt = dt
+	cube.maxDt = dt
+	cube.diff = diffusion
+	cube.visc = viscosity
+
+	opts.initialize()
+	cube.opts = opts
+	cube.pool = workerPoolCreate(threads)
+
+	cube.s = make([]float32, N*N*N)
+	cube.density = make([]float32, N*N*N)
+
+	cube.Vx = make([]float32, N*N*N)
+	cube.Vy = make([]float32, N*N*N)
+	cube.Vz = make([]float32, N*N*N)
+
+	cube.Vx0 = make([]float32, N*N*N)
+	cube.Vy0 = make([]float32, N*N*N)
+	cube.Vz0 = make([]float32, N*N*N)
+
+	return cube
+}
+
+func (cube *FluidCube3D) Step() {
+	if cube.opts.AdaptiveDt {
+		cube.dt = cube.cflTimestep()
+	}
+
+	N 		:= cube.size
+	pool 	:= cube.pool
+	visc 	:= cube.visc
+	diff 	:= cube.diff
+	dt 		:= cube.dt
+	Vx 		:= cube.Vx
+	Vy 		:= cube.Vy
+	Vz 		:= cube.Vz
+	Vx0 	:= cube.Vx0
+	Vy0 	:= cube.Vy0
+	Vz0 	:= cube.Vz0
+	s 		:= cube.s
+	density := cube.density
+	dIter 	:= cube.opts.DiffuseIterations
+	pIter 	:= cube.opts.PressureIterations
+	rb 		:= cube.opts.RedBlack
+
+	diffuse3d(1, Vx0, Vx, visc, dt, dIter, N, pool, rb)
+	diffuse3d(2, Vy0, Vy, visc, dt, dIter, N, pool, rb)
+	diffuse3d(3, Vz0, Vz, visc, dt, dIter, N, pool, rb)
+
+	project3d(Vx0, Vy0, Vz0, Vx, Vy, pIter, N, pool, rb)
+
+	advect3d(1, Vx, Vx0, Vx0, Vy0, Vz0, dt, N, pool)
+	advect3d(2, Vy, Vy0, Vx0, Vy0, Vz0, dt, N, pool)
+	advect3d(3, Vz, Vz0, Vx0, Vy0, Vz0, dt, N, pool)
+
+	project3d(Vx, Vy, Vz, Vx0, Vy0, pIter, N, pool, rb)
+
+	diffuse3d(0, s, density, diff, dt, dIter, N, pool, rb)
+	advect3d(0, density, s, Vx, Vy, Vz, dt, N, pool)
+
+	if cube.opts.Dissipation > 0 {
+		decay(density, cube.opts.Dissipation, N*N, pool)
+	}
+	if cube.opts.Damping > 0 {
+		decay(Vx, cube.opts.Damping, N*N, pool)
+		decay(Vy, cube.opts.Damping, N*N, pool)
+		decay(Vz, cube.opts.Damping, N*N, pool)
+	}
+}
+
+// same as FluidCube.cflTimestep
+func (cube *FluidCube3D) cflTimestep() float32 {
+	var maxVelocity float32
+	for index := range cube.Vx {
+		v := float32(math.Sqrt(float64(cube.Vx[index]*cube.Vx[index] + cube.Vy[index]*cube.Vy[index] + cube.Vz[index]*cube.Vz[index])))
+		if v > maxVelocity {
+			maxVelocity = v
+		}
+	}
+
+	if maxVelocity == 0 {
+		return cube.maxDt
+	}
+	dt := cube.opts.CFL / (float32(cube.size-2) * maxVelocity)
+	if dt > cube.maxDt {
+		return cube.maxDt
+	}
+	return dt
+}
+
+// timestep used by the last Step
+func (cube *FluidCube3D) Dt() float32 {
+	return cube.dt
+}
+
+// stops the cube's worker pool, the cube can't be stepped afterwards
+func (cube *FluidCube3D) Close() {
+	cube.pool.Close()
+}
+
+func (cube *FluidCube3D) Size() int {
+	return cube.size
+}
+
+func (cube *FluidCube3D) AddDensity(x, y, z int, amount float32) {
+	N := cube.size
+	cube.density[ix3(x, y, z, N)] += amount
+}
+
+func (cube *FluidCube3D) AddVelocity(x, y, z int, amountX, amountY, amountZ float32) {
+	N := cube.size
+	index := ix3(x, y, z, N)
+
+	cube.Vx[index] += amountX
+	cube.Vy[index] += amountY
+	cube.Vz[index] += amountZ
+}
+
+func (cube *FluidCube3D) Density(x, y, z int) float32 {
+	N := cube.size
+	return cube.density[ix3(x, y, z, N)]
+}
+
+func (cube *FluidCube3D) Velocity(x, y, z int) (float32, float32, float32) {
+	index := ix3(x, y, z, cube.size)
+	return cube.Vx[index], cube.Vy[index], cube.Vz[index]
+}
+
+
+//
+// Helper functions
+//
+
+func ix3(x, y, z, N int) int {
+	return x + y * N + z * N * N
+}
+
+// b is 0 for scalars and 1/2/3 for the x/y/z velocity
+func set_bnd3d(b int, x []float32, N int) {
+	for j:=1; j<N-1; j++ {
+		for i:=1; i<N-1; i++ {
+			if b == 3 {
+				x[ix3(i, j, 0, N)] = -x[ix3(i, j, 1, N)]
+				x[ix3(i, j, N-1, N)] = -x[ix3(i, j, N-2, N)]
+			} else {
+				x[ix3(i, j, 0, N)] = x[ix3(i, j, 1, N)]
+				x[ix3(i, j, N-1, N)] = x[ix3(i, j, N-2, N)]
+			}
+		}
+	}
+
+	for k:=1; k<N-1; k++ {
+		for i:=1; i<N-1; i++ {
+			if b == 2 {
+				x[ix3(i, 0, k, N)] = -x[ix3(i, 1, k, N)]
+				x[ix3(i, N-1, k, N)] = -x[ix3(i, N-2, k, N)]
+			} else {
+				x[ix3(i, 0, k, N)] = x[ix3(i, 1, k, N)]
+				x[ix3(i, N-1, k, N)] = x[ix3(i, N-2, k, N)]
+			}
+		}
+	}
+
+	for k:=1; k<N-1; k++ {
+		for j:=1; j<N-1; j++ {
+			if b == 1 {
+				x[ix3(0, j, k, N)] = -x[ix3(1, j, k, N)]
+				x[ix3(N-1, j, k, N)] = -x[ix3(N-2, j, k, N)]
+			} else {
+				x[ix3(0, j, k, N)] = x[ix3(1, j, k, N)]
+				x[ix3(N-1, j, k, N)] = x[ix3(N-2, j, k, N)]
+			}
+		}
+	}
+
+	x[ix3(0, 0, 0, N)]       = 0.33 * (x[ix3(1, 0, 0, N)] + x[ix3(0, 1, 0, N)] + x[ix3(0, 0, 1, N)])
+	x[ix3(0, N-1, 0, N)]     = 0.33 * (x[ix3(1, N-1, 0, N)] + x[ix3(0, N-2, 0, N)] + x[ix3(0, N-1, 1, N)])
+	x[ix3(0, 0, N-1, N)]     = 0.33 * (x[ix3(1, 0, N-1, N)] + x[ix3(0, 1, N-1, N)] + x[ix3(0, 0, N-2, N)])
+	x[ix3(0, N-1, N-1, N)]   = 0.33 * (x[ix3(1, N-1, N-1, N)] + x[ix3(0, N-2, N-1, N)] + x[ix3(0, N-1, N-2, N)])
+	x[ix3(N-1, 0, 0, N)]     = 0.33 * (x[ix3(N-2, 0, 0, N)] + x[ix3(N-1, 1, 0, N)] + x[ix3(N-1, 0, 1, N)])
+	x[ix3(N-1, N-1, 0, N)]   = 0.33 * (x[ix3(N-2, N-1, 0, N)] + x[ix3(N-1, N-2, 0, N)] + x[ix3(N-1, N-1, 1, N)])
+	x[ix3(N-1, 0, N-1, N)]   = 0.33 * (x[ix3(N-2, 0, N-1, N)] + x[ix3(N-1, 1, N-1, N)] + x[ix3(N-1, 0, N-2, N)])
+	x[ix3(N-1, N-1, N-1, N)] = 0.33 * (x[ix3(N-2, N-1, N-1, N)] + x[ix3(N-1, N-2, N-1, N)] + x[ix3(N-1, N-1, N-2, N)])
+}
+
+// Gauss-Seidel, if redBlack is set the cells are updated in red-black order and
+// the z slices are split across the worker pool
+func lin_solve3d(b int, x, x0 []float32, a, c float32, iter, N int, pool *workerPool, redBlack bool) {
+	cRecip := 1.0/c
+	for k:=0; k<iter; k++ {
+		if redBlack {
+			for colour:=0; colour<2; colour++ {
+				pool.forRows(1, N-1, func(start, end int) {
+					for m:=start; m<end; m++ {
+						for j:=1; j<N-1; j++ {
+							for i:=1+(m+j+colour+1)%2; i<N-1; i+=2 {
+								x[ix3(i, j, m, N)] = lin_solve3d_cell(x, x0, a, cRecip, i, j, m, N)
+							}
+						}
+					}
+				})
+			}
+		} else {
+			for m:=1; m<N-1; m++ {
+				for j:=1; j<N-1; j++ {
+					for i:=1; i<N-1; i++ {
+						x[ix3(i, j, m, N)] = lin_solve3d_cell(x, x0, a, cRecip, i, j, m, N)
+					}
+				}
+			}
+		}
+		set_bnd3d(b, x, N)
+	}
+}
+
+func lin_solve3d_cell(x, x0 []float32, a, cRecip float32, i, j, m, N int) float32 {
+	return (x0[ix3(i, j, m, N)] +
+		a * (x[ix3(i+1, j, m, N)] +
+			 x[ix3(i-1, j, m, N)] +
+			 x[ix3(i, j+1, m, N)] +
+			 x[ix3(i, j-1, m, N)] +
+			 x[ix3(i, j, m+1, N)] +
+			 x[ix3(i, j, m-1, N)])) * cRecip
+}
+
+func diffuse3d(b int, x, x0 []float32, diff, dt float32, iter, N int, pool *workerPool, redBlack bool) {
+	a := dt * diff * float32(N-2) * float32(N-2)
+	lin_solve3d(b, x, x0, a, 1 + 6 * a, iter, N, pool, redBlack)
+}
+
+func advect3d(b int, d, d0, velocX, velocY, velocZ []float32, dt float32, N int, pool *workerPool) {
+	dtx := dt * float32(N-2)
+	dty := dt * float32(N-2)
+	dtz := dt * float32(N-2)
+
+	Nfloat := float32(N)
+
+	// every cell only reads from d0 and the velocity arrays so slices can be split into bands
+	pool.forRows(1, N-1, func(start, end int) {
+		for k:=start; k<end; k++ {
+			for j:=1; j<N-1; j++ {
+				for i:=1; i<N-1; i++ {
+					index := ix3(i, j, k, N)
+					x := float32(i) - dtx * velocX[index]
+					y := float32(j) - dty * velocY[index]
+					z := float32(k) - dtz * velocZ[index]
+
+					// keep the backtraced position inside the cube (i1/j1/k1 can be at most N-1)
+					if x < 0.5 { x = 0.5 }
+					if x > Nfloat - 1.5 { x = Nfloat - 1.5 }
+					if y < 0.5 { y = 0.5 }
+					if y > Nfloat - 1.5 { y = Nfloat - 1.5 }
+					if z < 0.5 { z = 0.5 }
+					if z > Nfloat - 1.5 { z = Nfloat - 1.5 }
+
+					i0, j0, k0 := floorf(x), floorf(y), floorf(z)
+					s1, t1, u1 := x - i0, y - j0, z - k0
+					s0, t0, u0 := 1 - s1, 1 - t1, 1 - u1
+
+					i0i, j0i, k0i := int(i0), int(j0), int(k0)
+					i1i, j1i, k1i := i0i + 1, j0i + 1, k0i + 1
+
+					d[index] =
+						s0 * (t0 * (u0 * d0[ix3(i0i, j0i, k0i, N)] + u1 * d0[ix3(i0i, j0i, k1i, N)]) +
+							  t1 * (u0 * d0[ix3(i0i, j1i, k0i, N)] + u1 * d0[ix3(i0i, j1i, k1i, N)])) +
+						s1 * (t0 * (u0 * d0[ix3(i1i, j0i, k0i, N)] + u1 * d0[ix3(i1i, j0i, k1i, N)]) +
+							  t1 * (u0 * d0[ix3(i1i, j1i, k0i, N)] + u1 * d0[ix3(i1i, j1i, k1i, N)]))
+				}
+			}
+		}
+	})
+
+	set_bnd3d(b, d, N)
+}
+
+func project3d(velocX, velocY, velocZ, p, div []float32, iter, N int, pool *workerPool, redBlack bool) {
+	pool.forRows(1, N-1, func(start, end int) {
+		for k:=start; k<end; k++ {
+			for j:=1; j<N-1; j++ {
+				for i:=1; i<N-1; i++ {
+					div[ix3(i, j, k, N)] = -0.5*(
+						velocX[ix3(i+1, j, k, N)] -
+						velocX[ix3(i-1, j, k, N)] +
+						velocY[ix3(i, j+1, k, N)] -
+						velocY[ix3(i, j-1, k, N)] +
+						velocZ[ix3(i, j, k+1, N)] -
+						velocZ[ix3(i, j, k-1, N)])/float32(N)
+					p[ix3(i, j, k, N)] = 0
+				}
+			}
+		}
+	})
+
+	set_bnd3d(0, div, N)
+	set_bnd3d(0, p, N)
+	lin_solve3d(0, p, div, 1, 6, iter, N, pool, redBlack)
+
+	pool.forRows(1, N-1, func(start, end int) {
+		for k:=start; k<end; k++ {
+			for j:=1; j<N-1; j++ {
+				for i:=1; i<N-1; i++ {
+					velocX[ix3(i, j, k, N)] -= 0.5 * (p[ix3(i+1, j, k, N)] - p[ix3(i-1, j, k, N)]) * float32(N)
+					velocY[ix3(i, j, k, N)] -= 0.5 * (p[ix3(i, j+1, k, N)] - p[ix3(i, j-1, k, N)]) * float32(N)
+					velocZ[ix3(i, j, k, N)] -= 0.5 * (p[ix3(i, j, k+1, N)] - p[ix3(i, j, k-1, N)]) * float32(N)
+				}
+			}
+		}
+	})
+
+	set_bnd3d(1, velocX, N)
+	set_bnd3d(2, velocY, N)
+	set_bnd3d(3, velocZ, N)
+}
@@ -0,0 +1,105 @@
+package fluid
+
+import (
+	"math"
+)
+
+// Vorticity confinement (Fedkiw, Stam and Jensen 2001). The semi-Lagrangian advect
+// step smears out small eddies, so the curl of the velocity field is computed and
+// a force pushing the flow around the peaks of |curl| is added back in:
+//
+//     f = epsilon * h * (n x curl),  n = grad|curl| / |grad|curl||
+//
+// curl is a scratch array of the same size as the velocity arrays.
+func vorticity_confinement[T Float](velocX, velocY, curl []T, epsilon, dt T, g *grid) {
+	W, H, N, pool := g.W, g.H, g.N, g.pool
+	h := 1 / T(N-2)
+
+	// curl of the velocity field (in 2D it only has a z component)
+	pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				curl[ix(i, j, W)] = 0.5 * ((velocY[ix(i+1, j, W)] - velocY[ix(i-1, j, W)]) -
+					(velocX[ix(i, j+1, W)] - velocX[ix(i, j-1, W)])) / h
+			}
+		}
+	})
+	set_bnd(0, curl, g)
+
+	pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				// gradient of |curl|, the scaling cancels out when it's normalized
+				nx := abs(curl[ix(i+1, j, W)]) - abs(curl[ix(i-1, j, W)])
+				ny := abs(curl[ix(i, j+1, W)]) - abs(curl[ix(i, j-1, W)])
+				length := T(math.Sqrt(float64(nx*nx + ny*ny)))
+				if length < 1e-20 {
+					continue
+				}
+				nx /= length
+				ny /= length
+
+				w := curl[ix(i, j, W)]
+				velocX[ix(i, j, W)] += dt * epsilon * h * ny * w
+				velocY[ix(i, j, W)] -= dt * epsilon * h * nx * w
+			}
+		}
+	})
+	set_bnd(1, velocX, g)
+	set_bnd(2, velocY, g)
+}
+
+// Buoyancy for smoke and hot gas. Fluid hotter than the ambient temperature is
+// lifted, dye is pulled down by its weight:
+//
+//     f = lift * (T - ambient) - weight * density
+//
+// The GIF's y axis points down so an upward force decreases Vy.
+func buoyancy[T Float](velocY, density, temperature []T, ambient, lift, weight, dt T, g *grid) {
+	W, H := g.W, g.H
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				velocY[index] -= dt * (lift * (temperature[index] - ambient) - weight * density[index])
+			}
+		}
+	})
+	set_bnd(2, velocY, g)
+}
+
+func abs[T Float](x T) T {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Applies Options.Dissipation to the density + dyes and Options.Damping to the
+// velocity. The reaction's species aren't dissipated, the reaction balances them.
+func dissipate[T Float](opts *Options, density []T, dyes [][]T, velocX, velocY []T, g *grid) {
+	if opts.Dissipation > 0 {
+		decay(density, T(opts.Dissipation), g.W, g.pool)
+		for channel, dye := range dyes {
+			if opts.Reaction && channel < 2 {
+				continue
+			}
+			decay(dye, T(opts.Dissipation), g.W, g.pool)
+		}
+	}
+	if opts.Damping > 0 {
+		decay(velocX, T(opts.Damping), g.W, g.pool)
+		decay(velocY, T(opts.Damping), g.W, g.pool)
+	}
+}
+
+// scales a whole field (ghost cells too) down by rate, the fraction lost every tick.
+// The field is split into rows of rowLength values across the pool.
+func decay[T Float](field []T, rate T, rowLength int, pool *workerPool) {
+	factor := 1 - rate
+	pool.forRows(0, len(field)/rowLength, func(start, end int) {
+		for index:=start*rowLength; index<end*rowLength; index++ {
+			field[index] *= factor
+		}
+	})
+}
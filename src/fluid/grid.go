@@ -0,0 +1,105 @@
+package fluid
+
+// grid describes the shape of the simulation grid and which of its cells are walls.
+// Every solver helper gets one so they all treat the boundaries the same way.
+type grid struct {
+	W, H      int            // width and height including the boundary cells
+	N         int            // the larger of W and H, the grid is 1 unit long on that side so cells are 1/(N-2) wide
+	pool      *workerPool    // goroutines the row loops are split across
+	solid     []bool         // solid obstacle cells (nil if there are no obstacles)
+	obstacles []obstacleCell // every solid interior cell, set_bnd fills them in from their fluid neighbours
+	weight    []float32      // how much of a cell's own pressure set_bnd(3) puts into its neighbours (see poisson_diagonal)
+	bnd       Boundaries     // boundary conditions of the outer edges
+}
+
+// solid cell whose boundary value is set from the fluid cells next to it
+type obstacleCell struct {
+	index      int
+	neighbours []int // fluid neighbours, enclosed cells have none and are set to 0
+}
+
+
+//
+// grid functions
+//
+
+func gridCreate(W, H int, pool *workerPool, solid []bool, bnd Boundaries) *grid {
+	N := W
+	if H > N {
+		N = H
+	}
+	g := &grid{W: W, H: H, N: N, pool: pool, solid: solid, bnd: bnd}
+
+	if solid != nil {
+		for j:=1; j<H-1; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				if !solid[index] {
+					continue
+				}
+
+				cell := obstacleCell{index: index}
+				for _, n := range [4]int{ix(i+1, j, W), ix(i-1, j, W), ix(i, j+1, W), ix(i, j-1, W)} {
+					if g.interior(n) && !solid[n] {
+						cell.neighbours = append(cell.neighbours, n)
+					}
+				}
+				g.obstacles = append(g.obstacles, cell)
+			}
+		}
+	}
+
+	// walls give a cell its own value back (outflow edges its negation, periodic ones
+	// none), obstacles share it between all their fluid neighbours
+	g.weight = make([]float32, W*H)
+	for j:=1; j<H-1; j++ {
+		for i:=1; i<W-1; i++ {
+			if i == 1 { g.weight[ix(i, j, W)] += edge_weight(&bnd.Left) }
+			if i == W-2 { g.weight[ix(i, j, W)] += edge_weight(&bnd.Right) }
+			if j == 1 { g.weight[ix(i, j, W)] += edge_weight(&bnd.Top) }
+			if j == H-2 { g.weight[ix(i, j, W)] += edge_weight(&bnd.Bottom) }
+		}
+	}
+	for _, cell := range g.obstacles {
+		for _, n := range cell.neighbours {
+			g.weight[n] += 1 / float32(len(cell.neighbours))
+		}
+	}
+
+	return g
+}
+
+// true if the cell isn't part of an obstacle
+func (g *grid) fluid(index int) bool {
+	return g.solid == nil || !g.solid[index]
+}
+
+// true if the cell isn't on the outer boundary
+func (g *grid) interior(index int) bool {
+	i, j := index % g.W, index / g.W
+	return i > 0 && i < g.W-1 && j > 0 && j < g.H-1
+}
+
+// Grid with half the resolution for multigrid. A coarse cell is only solid if all
+// the fine cells it covers are solid so narrow channels stay open.
+func (g *grid) coarsen() *grid {
+	Wf, Hf := g.W, g.H
+	Wc, Hc := (Wf-2+1)/2 + 2, (Hf-2+1)/2 + 2
+
+	var solid []bool
+	if g.solid != nil {
+		solid = make([]bool, Wc*Hc)
+		for J:=1; J<Hc-1; J++ {
+			for I:=1; I<Wc-1; I++ {
+				all := true
+				for j:=2*J-1; j<=2*J && j<Hf-1; j++ {
+					for i:=2*I-1; i<=2*I && i<Wf-1; i++ {
+						all = all && g.solid[ix(i, j, Wf)]
+					}
+				}
+				solid[ix(I, J, Wc)] = all
+			}
+		}
+	}
+	return gridCreate(Wc, Hc, g.pool, solid, g.bnd)
+}
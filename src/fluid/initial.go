@@ -0,0 +1,85 @@
+package fluid
+
+import (
+	"image"
+	"image/color"
+)
+
+// dye channels initialColors uses if the job doesn't set any
+var RGB_DYES = [3]Dye{
+	{Color: [3]float32{1, 0, 0}},
+	{Color: [3]float32{0, 1, 0}},
+	{Color: [3]float32{0, 0, 1}},
+}
+
+
+//
+// Helper functions
+//
+
+// Fills a new cube from the initialDensity and initialVelocity images. They're
+// stretched over the grid like the mask, transparent pixels add nothing. In the
+// velocity image red is Vx and green Vy, 128 is still, 0 and 255 are -/+ the
+// velocity scale. Obstacles stay empty.
+func loadInitialState(cube *FluidCube, opts *Options) error {
+	W, H := cube.Width(), cube.Height()
+
+	if opts.InitialDensity != "" {
+		img, err := loadImage(opts.InitialDensity); if err != nil {
+			return err
+		}
+		for y:=1; y<H-1; y++ {
+			for x:=1; x<W-1; x++ {
+				if cube.Solid(x, y) {
+					continue
+				}
+				pixel := sample(img, x, y, W, H)
+				if opts.InitialColors {
+					r, g, b, _ := pixel.RGBA()
+					for channel, value := range [3]uint32{r, g, b} {
+						cube.AddDye(channel, x, y, opts.InitialAmount * float32(value) / 0xFFFF)
+					}
+				} else {
+					gray := color.Gray16Model.Convert(pixel).(color.Gray16)
+					cube.AddDensity(x, y, opts.InitialAmount * float32(gray.Y) / 0xFFFF)
+				}
+			}
+		}
+	}
+
+	if opts.InitialVelocity != "" {
+		img, err := loadImage(opts.InitialVelocity); if err != nil {
+			return err
+		}
+		for y:=1; y<H-1; y++ {
+			for x:=1; x<W-1; x++ {
+				if cube.Solid(x, y) {
+					continue
+				}
+				pixel := color.NRGBA64Model.Convert(sample(img, x, y, W, H)).(color.NRGBA64)
+				if pixel.A == 0 {
+					continue
+				}
+				cube.AddVelocity(x, y, opts.VelocityScale * signed(pixel.R), opts.VelocityScale * signed(pixel.G))
+			}
+		}
+	}
+	return nil
+}
+
+// nearest pixel of an image stretched over a W*H grid
+func sample(img image.Image, x, y, W, H int) color.Color {
+	bounds := img.Bounds()
+	px := bounds.Min.X + x * bounds.Dx() / W
+	py := bounds.Min.Y + y * bounds.Dy() / H
+	return img.At(px, py)
+}
+
+// maps a colour channel to -1..1 with 128 (0x8080) at 0
+func signed(value uint16) float32 {
+	v := (float32(value) - 0x8080) / 0x7F7F
+	if v < -1 {
+		return -1
+	}
+	return v
+}
@@ -0,0 +1,449 @@
+package fluid
+
+import (
+	"math"
+)
+
+// lbmCube is the D2Q9 lattice Boltzmann backend (Options.Backend "lbm"). Instead of
+// solving for the pressure every cell keeps 9 particle distributions f_i, one for
+// each lattice direction c_i. Every step they are streamed to the neighbouring cell
+// they point at and relaxed towards their equilibrium (BGK collision):
+//
+//     f_i(x + c_i, t + 1) = f_i(x, t) - (f_i(x, t) - feq_i(rho, u)) / tau
+//
+// A cell only needs its neighbours' distributions from the last step, so the rows
+// are split across the worker pool without any synchronisation inside a step.
+//
+// Velocities are converted to lattice units (cells per step) the same way advect
+// moves cells, dt * (N-2) * velocity, and the viscosity becomes the relaxation time
+// tau = 3 * dt * visc * (N-2)^2 + 0.5. Walls + obstacles bounce the distributions
+// back, free-slip edges reflect them. The density, dye channels and temperature
+// are passive scalars that are diffused + advected by the lattice velocity with the
+// stable fluids helpers.
+type lbmCube[T Float] struct {
+	width 	int	// cells across, including the boundary cells
+	height 	int	// cells down, including the boundary cells
+	dt 	 	T 	// length of the timestep
+	diff 	T 	// diffusion of the density
+	tau 	T 	// relaxation time, from the viscosity
+
+	f 		[]T // 9 distributions per cell
+	f0 		[]T // scratch space the distributions are streamed into
+
+	Vx 		[]T // velocity array, in the same units as fluidCube's
+	Vy 		[]T // velocity array, in the same units as fluidCube's
+	force 	[]T // scratch space for the buoyancy (nil if the temperature is disabled)
+
+	s 		[]T   // scratch space density array
+	density []T   // density array
+	dyes 	[][]T // extra dye channels (see Options.Dyes)
+
+	temperature  []T // temperature array (nil if disabled)
+	temperature0 []T // scratch space temperature array
+
+	advect0 []T // scratch space for maccormack + bfecc advection (nil otherwise)
+	advect1 []T // scratch space for maccormack + bfecc advection (nil otherwise)
+
+	grid *grid   // grid shape, obstacles + the worker pool the rows are split across
+	opts Options // solver settings
+
+	diffuseStats SolveStats // how the last density diffusion converged
+}
+
+const LBM_MIN_TAU float64   = 0.52 // BGK collisions blow up as tau gets close to 0.5
+const LBM_MAX_SPEED float64 = 0.2  // lattice units, LBM is only accurate well below the speed of sound (0.58)
+
+// D2Q9 directions: rest, the 4 axes, then the 4 diagonals
+var lbm_cx = [9]int{0, 1, 0, -1, 0, 1, -1, -1, 1}
+var lbm_cy = [9]int{0, 0, 1, 0, -1, 1, 1, -1, -1}
+var lbm_weight = [9]float64{4.0/9, 1.0/9, 1.0/9, 1.0/9, 1.0/9, 1.0/36, 1.0/36, 1.0/36, 1.0/36}
+
+// direction pointing the other way, and the direction mirrored in the y/x axis
+var lbm_opposite = [9]int{0, 3, 4, 1, 2, 7, 8, 5, 6}
+var lbm_mirrorX = [9]int{0, 3, 2, 1, 4, 6, 5, 8, 7}
+var lbm_mirrorY = [9]int{0, 1, 4, 3, 2, 8, 7, 6, 5}
+
+
+//
+// lbmCube functions
+//
+
+func lbmCubeCreate[T Float](width, height int, diffusion, viscosity, dt float32, threads int, opts Options) *lbmCube[T] {
+	cube := &lbmCube[T]{}
+	size := width * height
+
+	cube.width = width
+	cube.height = height
+	cube.dt = T(dt)
+	cube.diff = T(diffusion)
+	cube.opts = opts
+
+	solid, err := solidMask(width, height, opts.Mask, opts.Obstacles); if err != nil {
+		panic(err)
+	}
+	cube.grid = gridCreate(width, height, workerPoolCreate(threads), solid, opts.Boundary)
+
+	N := float64(cube.grid.N)
+	cube.tau = T(math.Max(3 * float64(dt) * float64(viscosity) * (N-2) * (N-2) + 0.5, LBM_MIN_TAU))
+
+	// fluid at rest everywhere
+	cube.f = make([]T, 9*size)
+	cube.f0 = make([]T, 9*size)
+	for index:=0; index<size; index++ {
+		for k:=0; k<9; k++ {
+			cube.f[9*index + k] = lbm_equilibrium[T](k, 1, 0, 0)
+		}
+	}
+
+	cube.Vx = make([]T, size)
+	cube.Vy = make([]T, size)
+
+	cube.s = make([]T, size)
+	cube.density = make([]T, size)
+	for range opts.Dyes {
+		cube.dyes = append(cube.dyes, make([]T, size))
+	}
+
+	if opts.Temperature {
+		cube.force = make([]T, size)
+		cube.temperature = make([]T, size)
+		cube.temperature0 = make([]T, size)
+		for index := range cube.temperature {
+			cube.temperature[index] = T(opts.AmbientTemperature)
+		}
+	}
+
+	if opts.Advection == "maccormack" || opts.Advection == "bfecc" {
+		cube.advect0 = make([]T, size)
+		cube.advect1 = make([]T, size)
+	}
+
+	return cube
+}
+
+func (cube *lbmCube[T]) Step() {
+	g := cube.grid
+	W, H := g.W, g.H
+	opts := &cube.opts
+	scale := cube.lattice()
+	tau := cube.tau
+
+	// buoyancy is added as a force, the equilibrium velocity is shifted by tau times
+	// the velocity it adds in one step
+	force := cube.force
+	damping := T(opts.Damping)
+	if force != nil {
+		for index := range force {
+			force[index] = 0
+		}
+		buoyancy(force, cube.density, cube.temperature, T(opts.AmbientTemperature), T(opts.Lift), T(opts.Weight), cube.dt, g)
+	}
+
+	cube.fillEdges()
+
+	f, f0 := cube.f, cube.f0
+	g.pool.forRows(1, H-1, func(start, end int) {
+		var dist [9]T
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				if !g.fluid(index) {
+					continue
+				}
+
+				for k:=0; k<9; k++ {
+					dist[k] = cube.pull(i, j, k)
+				}
+				rho, ux, uy := lbm_moments(&dist)
+
+				uxEq, uyEq := ux, uy
+				if force != nil {
+					uyEq += tau * scale * force[index]
+				}
+				if damping > 0 {
+					uxEq -= tau * damping * ux
+					uyEq -= tau * damping * uy
+				}
+				uxEq, uyEq = lbm_clamp(uxEq, uyEq)
+
+				for k:=0; k<9; k++ {
+					f0[9*index + k] = dist[k] - (dist[k] - lbm_equilibrium(k, rho, uxEq, uyEq)) / tau
+				}
+				cube.Vx[index] = ux / scale
+				cube.Vy[index] = uy / scale
+			}
+		}
+	})
+	cube.f, cube.f0 = f0, f
+	set_bnd(1, cube.Vx, g)
+	set_bnd(2, cube.Vy, g)
+
+	dIter := opts.DiffuseIterations
+	rb := opts.RedBlack
+	tol := T(opts.Tolerance)
+	st := T(opts.stencil())
+
+	cube.diffuseStats = diffuse(0, cube.s, cube.density, cube.diff, cube.dt, dIter, g, rb, tol, st)
+	cube.advectField(cube.density, cube.s)
+
+	for channel, dye := range cube.dyes {
+		dyeDiff := T(opts.Dyes[channel].Diffusion)
+		if dyeDiff == 0 {
+			dyeDiff = cube.diff
+		}
+		diffuse(0, cube.s, dye, dyeDiff, cube.dt, dIter, g, rb, tol, st)
+		cube.advectField(dye, cube.s)
+	}
+
+	if cube.temperature != nil {
+		temp, temp0 := cube.temperature, cube.temperature0
+		diffuse(0, temp0, temp, T(opts.TemperatureDiffusion), cube.dt, dIter, g, rb, tol, st)
+		cube.advectField(temp, temp0)
+	}
+
+	// the damping is applied in the collision above
+	dissipate(opts, cube.density, cube.dyes, nil, nil, g)
+}
+
+// advects a scalar field with the lattice velocity
+func (cube *lbmCube[T]) advectField(d, d0 []T) {
+	advect_scheme(cube.opts.Advection, 0, d, d0, cube.Vx, cube.Vy, cube.dt, cube.grid, cube.advect0, cube.advect1)
+}
+
+// Distribution k that streams into interior cell (i, j), pulled from the cell it
+// comes from. Walls + obstacles bounce it back into the cell it left, free-slip
+// edges reflect it off the edge, periodic edges wrap around and inflow + outflow
+// edges stream in whatever fillEdges put into their boundary cells.
+func (cube *lbmCube[T]) pull(i, j, k int) T {
+	g := cube.grid
+	W, H := g.W, g.H
+	bnd := &g.bnd
+	f := cube.f
+	si, sj := i - lbm_cx[k], j - lbm_cy[k]
+
+	if bnd.periodicX() {
+		if si == 0 { si = W-2 }
+		if si == W-1 { si = 1 }
+	}
+	if bnd.periodicY() {
+		if sj == 0 { sj = H-2 }
+		if sj == H-1 { sj = 1 }
+	}
+
+	bounceBack := f[9*ix(i, j, W) + lbm_opposite[k]]
+	edgeX, edgeY := si == 0 || si == W-1, sj == 0 || sj == H-1
+	if !edgeX && !edgeY {
+		if !g.fluid(ix(si, sj, W)) {
+			return bounceBack
+		}
+		return f[9*ix(si, sj, W) + k]
+	}
+
+	var x, y *Edge
+	if si == 0 { x = &bnd.Left }
+	if si == W-1 { x = &bnd.Right }
+	if sj == 0 { y = &bnd.Top }
+	if sj == H-1 { y = &bnd.Bottom }
+	if lbm_open(x) || lbm_open(y) {
+		return f[9*ix(si, sj, W) + k]
+	}
+
+	// free-slip: comes from the cell next to this one along the edge, moving
+	// towards the edge
+	var ri, rj, mirrored int
+	switch {
+	case edgeX && edgeY:
+		return bounceBack
+	case edgeX && x.Type != "wall":
+		ri, rj, mirrored = i, sj, lbm_mirrorX[k]
+	case edgeY && y.Type != "wall":
+		ri, rj, mirrored = si, j, lbm_mirrorY[k]
+	default:
+		return bounceBack
+	}
+	if !g.interior(ix(ri, rj, W)) || !g.fluid(ix(ri, rj, W)) {
+		return bounceBack
+	}
+	return f[9*ix(ri, rj, W) + mirrored]
+}
+
+// Sets the distributions of the boundary cells of inflow + outflow edges. Inflow
+// cells are in equilibrium at the edge's velocity, outflow cells copy the cell
+// inside them (zero gradient).
+func (cube *lbmCube[T]) fillEdges() {
+	g := cube.grid
+	W, H := g.W, g.H
+	bnd := &g.bnd
+
+	fill := func(e *Edge, i, j, inside int) {
+		index := ix(i, j, W)
+		switch e.Type {
+		case "inflow":
+			ux, uy := lbm_clamp(T(e.Vx) * cube.lattice(), T(e.Vy) * cube.lattice())
+			for k:=0; k<9; k++ {
+				cube.f[9*index + k] = lbm_equilibrium(k, 1, ux, uy)
+			}
+		case "outflow":
+			copy(cube.f[9*index:9*index + 9], cube.f[9*inside:9*inside + 9])
+		}
+	}
+
+	for i:=0; i<W; i++ {
+		in := i
+		if in < 1 { in = 1 }
+		if in > W-2 { in = W-2 }
+		fill(&bnd.Top, i, 0, ix(in, 1, W))
+		fill(&bnd.Bottom, i, H-1, ix(in, H-2, W))
+	}
+	for j:=0; j<H; j++ {
+		in := j
+		if in < 1 { in = 1 }
+		if in > H-2 { in = H-2 }
+		fill(&bnd.Left, 0, j, ix(1, in, W))
+		fill(&bnd.Right, W-1, j, ix(W-2, in, W))
+	}
+}
+
+// lattice units (cells per step) per unit of velocity
+func (cube *lbmCube[T]) lattice() T {
+	return cube.dt * T(cube.grid.N-2)
+}
+
+// the lattice runs at a fixed timestep, adaptiveDt is ignored
+func (cube *lbmCube[T]) Dt() float32 {
+	return float32(cube.dt)
+}
+
+// stops the cube's worker pool, the cube can't be stepped afterwards
+func (cube *lbmCube[T]) Close() {
+	cube.grid.pool.Close()
+}
+
+func (cube *lbmCube[T]) Width() int {
+	return cube.width
+}
+
+func (cube *lbmCube[T]) Height() int {
+	return cube.height
+}
+
+func (cube *lbmCube[T]) AddDensity(x, y int, amount float32) {
+	W := cube.width
+	cube.density[ix(x, y, W)] += T(amount)
+}
+
+// Shifts the cell's distributions to the equilibrium at the new velocity, the
+// non-equilibrium part (the shear) is kept
+func (cube *lbmCube[T]) AddVelocity(x, y int, amountX, amountY float32) {
+	W := cube.width
+	index := ix(x, y, W)
+	dist := (*[9]T)(cube.f[9*index:9*index + 9])
+
+	rho, ux, uy := lbm_moments(dist)
+	newX, newY := lbm_clamp(ux + T(amountX) * cube.lattice(), uy + T(amountY) * cube.lattice())
+	for k:=0; k<9; k++ {
+		dist[k] += lbm_equilibrium(k, rho, newX, newY) - lbm_equilibrium(k, rho, ux, uy)
+	}
+	cube.Vx[index] = newX / cube.lattice()
+	cube.Vy[index] = newY / cube.lattice()
+}
+
+// does nothing if the temperature field is disabled
+func (cube *lbmCube[T]) AddTemperature(x, y int, amount float32) {
+	if cube.temperature == nil {
+		return
+	}
+	W := cube.width
+	cube.temperature[ix(x, y, W)] += T(amount)
+}
+
+func (cube *lbmCube[T]) Temperature(x, y int) float32 {
+	if cube.temperature == nil {
+		return cube.opts.AmbientTemperature
+	}
+	W := cube.width
+	return float32(cube.temperature[ix(x, y, W)])
+}
+
+func (cube *lbmCube[T]) Density(x, y int) float32 {
+	W := cube.width
+	return float32(cube.density[ix(x, y, W)])
+}
+
+func (cube *lbmCube[T]) AddDye(channel, x, y int, amount float32) {
+	W := cube.width
+	cube.dyes[channel][ix(x, y, W)] += T(amount)
+}
+
+func (cube *lbmCube[T]) Dye(channel, x, y int) float32 {
+	W := cube.width
+	return float32(cube.dyes[channel][ix(x, y, W)])
+}
+
+// number of dye channels
+func (cube *lbmCube[T]) DyeCount() int {
+	return len(cube.dyes)
+}
+
+// true if the cell is part of an obstacle
+func (cube *lbmCube[T]) Solid(x, y int) bool {
+	return !cube.grid.fluid(ix(x, y, cube.width))
+}
+
+func (cube *lbmCube[T]) Velocity(x, y int) (float32, float32) {
+	W := cube.width
+	return float32(cube.Vx[ix(x, y, W)]), float32(cube.Vy[ix(x, y, W)])
+}
+
+// iterations + residual of the density diffusion in the last Step
+func (cube *lbmCube[T]) DiffuseStats() SolveStats {
+	return cube.diffuseStats
+}
+
+// always zero, the lattice doesn't solve for the pressure
+func (cube *lbmCube[T]) PressureStats() SolveStats {
+	return SolveStats{}
+}
+
+func (cube *lbmCube[T]) diagnose() Diagnostics {
+	return diagnose(cube.grid, cube.density, cube.dyes, cube.Vx, cube.Vy)
+}
+
+
+//
+// Helper functions
+//
+
+func lbm_equilibrium[T Float](k int, rho, ux, uy T) T {
+	cu := 3 * (T(lbm_cx[k]) * ux + T(lbm_cy[k]) * uy)
+	return T(lbm_weight[k]) * rho * (1 + cu + 0.5 * cu * cu - 1.5 * (ux * ux + uy * uy))
+}
+
+// density + lattice velocity of a cell's distributions
+func lbm_moments[T Float](dist *[9]T) (T, T, T) {
+	var rho, ux, uy T
+	for k:=0; k<9; k++ {
+		rho += dist[k]
+		ux += T(lbm_cx[k]) * dist[k]
+		uy += T(lbm_cy[k]) * dist[k]
+	}
+	if rho == 0 {
+		return 0, 0, 0
+	}
+	return rho, ux / rho, uy / rho
+}
+
+// scales a lattice velocity down to LBM_MAX_SPEED
+func lbm_clamp[T Float](ux, uy T) (T, T) {
+	speed := math.Sqrt(float64(ux * ux + uy * uy))
+	if speed <= LBM_MAX_SPEED {
+		return ux, uy
+	}
+	factor := T(LBM_MAX_SPEED / speed)
+	return ux * factor, uy * factor
+}
+
+// true for edges whose boundary cells are filled in by fillEdges
+func lbm_open(e *Edge) bool {
+	return e != nil && (e.Type == "inflow" || e.Type == "outflow")
+}
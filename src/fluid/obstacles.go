@@ -0,0 +1,179 @@
+package fluid
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// Obstacle is a solid shape placed in the fluid, coordinates are in cells
+type Obstacle struct {
+	Shape  string  `json:"shape"`  // "circle" or "rectangle"
+	X      float32 `json:"x"`      // center of a circle, top left corner of a rectangle
+	Y      float32 `json:"y"`
+	Radius float32 `json:"radius"` // circle only
+	Width  float32 `json:"width"`  // rectangle only
+	Height float32 `json:"height"` // rectangle only
+}
+
+
+//
+// Obstacle functions
+//
+
+// Builds the solid cell mask from a mask image and a list of shapes, returns nil if
+// there aren't any. The image is stretched over the whole grid, dark pixels are solid.
+func solidMask(W, H int, maskPath string, obstacles []Obstacle) ([]bool, error) {
+	if maskPath == "" && len(obstacles) == 0 {
+		return nil, nil
+	}
+	solid := make([]bool, W*H)
+
+	if maskPath != "" {
+		img, err := loadImage(maskPath); if err != nil {
+			return nil, err
+		}
+		for y:=0; y<H; y++ {
+			for x:=0; x<W; x++ {
+				gray := color.Gray16Model.Convert(sample(img, x, y, W, H)).(color.Gray16)
+				if gray.Y < 0x8000 {
+					solid[ix(x, y, W)] = true
+				}
+			}
+		}
+	}
+
+	for _, o := range obstacles {
+		for y:=0; y<H; y++ {
+			for x:=0; x<W; x++ {
+				// test the center of the cell
+				fx, fy := float32(x) + 0.5, float32(y) + 0.5
+				switch o.Shape {
+				case "circle":
+					dx, dy := fx - o.X, fy - o.Y
+					if dx*dx + dy*dy <= o.Radius*o.Radius {
+						solid[ix(x, y, W)] = true
+					}
+				case "rectangle":
+					if fx >= o.X && fx < o.X + o.Width && fy >= o.Y && fy < o.Y + o.Height {
+						solid[ix(x, y, W)] = true
+					}
+				default:
+					return nil, errors.New("Unknown obstacle shape: " + o.Shape)
+				}
+			}
+		}
+	}
+
+	// the outer ring is handled by set_bnd's walls
+	for x:=0; x<W; x++ {
+		solid[ix(x, 0, W)] = false
+		solid[ix(x, H-1, W)] = false
+	}
+	for y:=0; y<H; y++ {
+		solid[ix(0, y, W)] = false
+		solid[ix(W-1, y, W)] = false
+	}
+	return solid, nil
+}
+
+// Loads a PNG, GIF or PGM (P2/P5) image
+func loadImage(path string) (image.Image, error) {
+	file, err := os.Open(path); if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(strings.ToLower(path), ".pgm") {
+		return decodePGM(bufio.NewReader(file))
+	}
+	img, _, err := image.Decode(file); if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return img, nil
+}
+
+// Minimal netpbm graymap decoder, image/ doesn't come with one
+func decodePGM(r *bufio.Reader) (image.Image, error) {
+	var magic string
+	var width, height, maxVal int
+
+	_, err := fmt.Fscan(r, &magic); if err != nil {
+		return nil, err
+	}
+	if magic != "P2" && magic != "P5" {
+		return nil, errors.New("not a PGM file: " + magic)
+	}
+
+	// header values may be separated by comments
+	header := []*int{&width, &height, &maxVal}
+	for _, v := range header {
+		err = skipPGMComments(r); if err != nil {
+			return nil, err
+		}
+		_, err = fmt.Fscan(r, v); if err != nil {
+			return nil, err
+		}
+	}
+	if width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 65535 {
+		return nil, errors.New("invalid PGM header")
+	}
+
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	if magic == "P5" {
+		// exactly one whitespace character between the header and the pixels
+		_, err = r.ReadByte(); if err != nil {
+			return nil, err
+		}
+	}
+
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			var v int
+			if magic == "P2" {
+				_, err = fmt.Fscan(r, &v)
+			} else if maxVal < 256 {
+				var b byte
+				b, err = r.ReadByte()
+				v = int(b)
+			} else {
+				var hi, lo byte
+				hi, err = r.ReadByte()
+				if err == nil {
+					lo, err = r.ReadByte()
+				}
+				v = int(hi) << 8 | int(lo)
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = errors.New("PGM file is truncated")
+				}
+				return nil, err
+			}
+			img.SetGray16(x, y, color.Gray16{uint16(v * 65535 / maxVal)})
+		}
+	}
+	return img, nil
+}
+
+func skipPGMComments(r *bufio.Reader) error {
+	for {
+		b, err := r.ReadByte(); if err != nil {
+			return err
+		}
+		if b == '#' {
+			_, err = r.ReadString('\n'); if err != nil {
+				return err
+			}
+		} else if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			return r.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package fluid
+
+import (
+	"encoding/json"
+)
+
+const DEFAULT_ITERATIONS int = 4
+const DEFAULT_CFL float32   = 1
+const DEFAULT_LIFT float32  = 1
+const DEFAULT_OPACITY float32 = 1
+
+// Options holds the optional per job settings of the fluid cube. They are read from
+// the same json object as the rest of the job, the zero value reproduces the
+// original simulation.
+type Options struct {
+	RedBlack           bool    `json:"redBlack"`           // red-black (checkerboard) ordering in lin_solve, rows are split across the worker pool
+	Solver             string  `json:"solver"`             // pressure solver: "gauss-seidel" (default), "jacobi", "cg" or "multigrid"
+	DiffuseIterations  int     `json:"diffuseIterations"`  // iterations used by diffuse (default 4)
+	PressureIterations int     `json:"pressureIterations"` // iterations used by the pressure solver (default 4)
+	Tolerance          float32 `json:"tolerance"`          // stop solving early once the residual drops below this, 0 disables
+	Physics            string  `json:"physics"`            // "legacy" (default) or "validated", see stencil()
+	Precision          string  `json:"precision"`          // "float32" (default) or "float64", what the 2D cube computes in
+	Backend            string  `json:"backend"`            // 2D solver: "stable-fluids" (default), "lbm" (lattice Boltzmann, see lbm.go), "flip" or "pic" (particles, see flip.go)
+	Dt                 float32 `json:"dt"`                 // length of the timestep (default FLOAT32_MIN), the upper bound in adaptive mode
+	AdaptiveDt         bool    `json:"adaptiveDt"`         // pick dt every tick from the CFL condition on the max velocity, saved to <outPath>.dt.csv
+	CFL                float32 `json:"cfl"`                // max cells the fastest fluid may move per tick in adaptive mode (default 1)
+	Vorticity          float32 `json:"vorticity"`          // vorticity confinement strength (epsilon), 0 disables
+	Advection          string  `json:"advection"`          // "semi-lagrangian" (default), "maccormack", "bfecc" or "cubic" (see advect.go)
+
+	Temperature          bool    `json:"temperature"`          // carry a temperature field, hot fluid rises (always on for "smoke-plume")
+	AmbientTemperature   float32 `json:"ambientTemperature"`   // temperature the fluid starts at, buoyancy depends on the difference to it
+	Lift                 float32 `json:"lift"`                 // upward force per degree above the ambient temperature (default 1)
+	Weight               float32 `json:"weight"`               // downward force per unit of dye
+	TemperatureDiffusion float32 `json:"temperatureDiffusion"` // how fast heat spreads out in the fluid
+
+	Reaction      bool    `json:"reaction"`      // Gray-Scott reaction between the first 2 dye channels (always on for "reaction-diffusion", see reaction.go)
+	Feed          float32 `json:"feed"`          // how fast species u is fed in (default 0.055)
+	Kill          float32 `json:"kill"`          // how fast species v is removed (default 0.062)
+	DiffusionU    float32 `json:"diffusionU"`    // how far u spreads, in cells^2 per reaction step (default 0.2)
+	DiffusionV    float32 `json:"diffusionV"`    // how far v spreads, in cells^2 per reaction step (default 0.1)
+	ReactionSteps int     `json:"reactionSteps"` // reaction steps per tick (default 10)
+
+	Mask      string     `json:"mask"`      // PNG, GIF or PGM image stretched over the grid, dark pixels are solid
+	Obstacles []Obstacle `json:"obstacles"` // solid circles and rectangles (see obstacles.go)
+	Boundary  Boundaries `json:"boundary"`  // boundary condition of every edge (see boundary.go)
+	Dyes      []Dye      `json:"dyes"`      // coloured dye channels on top of the white density (see dye.go)
+	Tracers   Tracers    `json:"tracers"`   // massless particles drawn on top of the density (see tracers.go)
+	Emitters  []Emitter  `json:"emitters"`  // dye, velocity + heat sources with keyframed paths, run every tick (see emitters.go, 2D only)
+
+	InitialDensity  string  `json:"initialDensity"`  // PNG, GIF or PGM image stretched over the grid, its brightness is the starting density (see initial.go)
+	InitialColors   bool    `json:"initialColors"`   // put the red, green + blue of initialDensity into the first 3 dye channels instead
+	InitialAmount   float32 `json:"initialAmount"`   // density of a white pixel (default 1)
+	InitialVelocity string  `json:"initialVelocity"` // image whose red + green are the starting Vx + Vy, mid grey (128) is still
+	VelocityScale   float32 `json:"velocityScale"`   // velocity of a fully red or green pixel (default 1)
+
+	Dissipation  float32 `json:"dissipation"`  // fraction of the density + dye lost every tick, keeps long runs from saturating to white
+	Damping      float32 `json:"damping"`      // fraction of the velocity lost every tick
+	FadeOutTicks int     `json:"fadeOutTicks"` // how many ticks at the end don't get new dye, turns fadeOut on (default 50, at most half the job)
+
+	Params json.RawMessage `json:"params"` // parameters of the simulation type, e.g. {"speed": 2} for "jet" (see simtypes.go)
+	Seed   int64           `json:"seed"`   // seed of the simulation's random numbers, 0 picks a different one every run
+
+	Diagnostics string `json:"diagnostics"` // .csv or .jsonl file the cube's Diagnostics are written to every tick (2D only)
+	AbortOnNaN  bool   `json:"abortOnNaN"`  // panic as soon as a diagnostic is NaN or infinite instead of drawing garbage
+
+	Dimensions int     `json:"dimensions"` // 2 (default) or 3 for a FluidCube3D
+	Render     string  `json:"render"`     // how 3D cubes are drawn: "slice" (default), "mip" or "raymarch" (see render.go)
+	Axis       string  `json:"axis"`       // axis a 3D cube is viewed along: "x", "y" or "z" (default)
+	Slice      int     `json:"slice"`      // slice drawn in "slice" mode (default the middle one)
+	Opacity    float32 `json:"opacity"`    // light absorbed per unit of dye in "raymarch" mode (default 1)
+}
+
+// fills in defaults for the unset options
+func (opts *Options) initialize() {
+	if opts.DiffuseIterations <= 0 { opts.DiffuseIterations = DEFAULT_ITERATIONS }
+	if opts.PressureIterations <= 0 { opts.PressureIterations = DEFAULT_ITERATIONS }
+	if opts.Tolerance < 0 { opts.Tolerance = 0 }
+	if opts.Dt <= 0 { opts.Dt = FLOAT32_MIN }
+	if opts.CFL <= 0 { opts.CFL = DEFAULT_CFL }
+	for _, e := range opts.Emitters {
+		if e.Temperature != 0 { opts.Temperature = true }
+	}
+	if opts.Temperature && opts.Lift == 0 { opts.Lift = DEFAULT_LIFT }
+	if opts.Reaction {
+		if opts.Feed == 0 { opts.Feed = DEFAULT_FEED }
+		if opts.Kill == 0 { opts.Kill = DEFAULT_KILL }
+		if opts.DiffusionU == 0 { opts.DiffusionU = DEFAULT_DIFFUSION_U }
+		if opts.DiffusionV == 0 { opts.DiffusionV = DEFAULT_DIFFUSION_V }
+		if opts.ReactionSteps <= 0 { opts.ReactionSteps = DEFAULT_REACTION_STEPS }
+		for len(opts.Dyes) < 2 {
+			opts.Dyes = append(opts.Dyes, DEFAULT_SPECIES[len(opts.Dyes)])
+		}
+	}
+	if opts.InitialAmount == 0 { opts.InitialAmount = 1 }
+	if opts.VelocityScale == 0 { opts.VelocityScale = 1 }
+	if opts.InitialColors && len(opts.Dyes) == 0 {
+		opts.Dyes = append(opts.Dyes, RGB_DYES[:]...)
+	}
+	if opts.Dimensions == 0 { opts.Dimensions = 2 }
+	if opts.Opacity <= 0 { opts.Opacity = DEFAULT_OPACITY }
+
+	opts.Boundary.validate()
+	opts.Tracers.initialize()
+
+	// copied so the defaults don't end up in the caller's slice
+	opts.Emitters = append([]Emitter(nil), opts.Emitters...)
+	for i := range opts.Emitters {
+		opts.Emitters[i].initialize(len(opts.Dyes))
+	}
+
+	switch opts.Physics {
+	case "", "legacy", "validated":
+	default:
+		panic("Unknown physics mode: " + opts.Physics)
+	}
+
+	switch opts.Precision {
+	case "", "float32", "float64":
+	default:
+		panic("Unknown precision: " + opts.Precision)
+	}
+	switch opts.Backend {
+	case "", "stable-fluids", "lbm", "flip", "pic":
+	default:
+		panic("Unknown backend: " + opts.Backend)
+	}
+	if opts.Reaction && opts.Backend != "" && opts.Backend != "stable-fluids" {
+		panic("The reaction only runs on the stable-fluids backend")
+	}
+	switch opts.Advection {
+	case "", "semi-lagrangian", "maccormack", "bfecc", "cubic":
+	default:
+		panic("Unknown advection scheme: " + opts.Advection)
+	}
+
+	if opts.Dissipation < 0 || opts.Dissipation > 1 || opts.Damping < 0 || opts.Damping > 1 {
+		panic("dissipation and damping have to be between 0 and 1")
+	}
+
+	if opts.Dimensions != 2 && opts.Dimensions != 3 {
+		panic("dimensions has to be 2 or 3")
+	}
+	if opts.Dimensions == 3 && len(opts.Emitters) > 0 {
+		panic("Emitters only work in 2D")
+	}
+	if opts.Dimensions == 3 && (opts.InitialDensity != "" || opts.InitialVelocity != "") {
+		panic("Initial images only work in 2D")
+	}
+	if opts.InitialColors && len(opts.Dyes) < 3 {
+		panic("initialColors needs 3 dye channels")
+	}
+	switch opts.Render {
+	case "", "slice", "mip", "raymarch":
+	default:
+		panic("Unknown render mode: " + opts.Render)
+	}
+	switch opts.Axis {
+	case "", "x", "y", "z":
+	default:
+		panic("Unknown axis: " + opts.Axis)
+	}
+}
+
+// Diagonal coefficient of the diffusion and pressure stencils (1 + stencil*a in
+// diffuse, stencil in project). The legacy mode keeps the 6 neighbours of Mike Ash's
+// 3D code so old GIFs can be reproduced, in 2D each cell only has 4 neighbours.
+func (opts *Options) stencil() float32 {
+	if opts.Physics == "validated" {
+		return 4
+	}
+	return 6
+}
@@ -15,7 +15,8 @@ type Task struct {
 type writeTask struct {
 	sg	   *SimulationGIF
 	bounds image.Rectangle
-	cube   densityCube 		// FluidCube (Regular mode) or cacheCube (BSP mode)
+	cube   densityCube 		// FluidCube or volumeView (Regular mode) or cacheCube (BSP mode)
+	tracers []float32		// tracer layer drawn on top of the cube (nil if there are no tracers)
 	parent int
 	id	   int
 }
@@ -63,6 +64,8 @@ func Worker(tasks <-chan *Task, workerId, threadCount int,  mainWg *sync.WaitGro
 			doWork(task, threadCount, writeTasks, frameDone)
 		}
 
+		// simulation is finished, stop the fluid cube's worker pool
+		task.sg.Close()
 
 		// save the image
 		task.sg.Save()
@@ -80,7 +83,7 @@ func doWork(task *Task, threadCount int, writeTasks chan<- *writeTask, frameDone
 		// push image chunks to write to writeTasks channel
 		// image chunks will be handled by writerWorkers
 		for i:=0; i<threadCount; i++ {
-			writeTasks <- &writeTask{task.sg, task.sg.GIF.Bounds(i), task.sg.sim.cube, i, task.id}
+			writeTasks <- &writeTask{task.sg, task.sg.GIF.Bounds(i), task.sg.sim.view, task.sg.sim.tracerLayer(), i, task.id}
 		}
 
 		// wait for writers to finish writing current frame
@@ -112,6 +115,10 @@ func doWorkBSP(task *Task, threadCount int, writeTasks chan<- *writeTask, frameD
 	// create barrier
 	bar := barrier.BarrierCreate(threadCount+1, frameDone, simWorkerDone)
 
+	// the first frame is written from prevState too, it has to show the starting
+	// state (obstacles, initial dye) like in the other modes
+	task.sg.sim.UpdatePrevState()
+
 	// cycle through GIF frames
 	for i:=0; i<int(task.sg.GIF.Frames()); i++ {
 
@@ -121,7 +128,7 @@ func doWorkBSP(task *Task, threadCount int, writeTasks chan<- *writeTask, frameD
 		// push image chunks to write to writeTasks channel
 		// image chunks will be handled by writerWorkers
 		for i:=0; i<threadCount; i++ {
-			writeTasks <- &writeTask{task.sg, task.sg.GIF.Bounds(i), task.sg.sim.cubePrevState, i, task.id}
+			writeTasks <- &writeTask{task.sg, task.sg.GIF.Bounds(i), task.sg.sim.cubePrevState, task.sg.sim.tracersPrevState, i, task.id}
 		}
 		
 		// tell sim worker to start work
@@ -147,7 +154,7 @@ func writerWorker(tasks <-chan *writeTask, done chan<- struct{}, writerWorkerId
 			workerWg.Done()
 			return
 		}
-		task.sg.writeFrameChunk(task.cube, task.bounds)
+		task.sg.writeFrameChunk(task.cube, task.tracers, task.bounds)
 		done <- struct{}{}
 	}
 }
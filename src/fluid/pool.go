@@ -0,0 +1,100 @@
+package fluid
+
+import (
+	"sync"
+)
+
+// workerPool is owned by a FluidCube and splits the row loops of the solver into
+// bands which are handled by a fixed number of goroutines. With one thread no
+// goroutines are spawned and every loop runs on the calling goroutine.
+type workerPool struct {
+	threads int           // how many bands each loop is split into
+	jobs    chan poolJob  // bands waiting to be handled by a worker (nil if sequential)
+	wg      sync.WaitGroup // bands of the current loop that haven't finished yet
+}
+
+type poolJob struct {
+	fn   func(start, end int)
+	band rowBand
+}
+
+type rowBand struct {
+	start int // first row (inclusive)
+	end   int // last row (exclusive)
+}
+
+
+//
+// workerPool functions
+//
+
+func workerPoolCreate(threads int) *workerPool {
+	if threads < 1 {
+		threads = 1
+	}
+
+	pool := &workerPool{threads: threads}
+	if threads > 1 {
+		pool.jobs = make(chan poolJob, threads)
+		for i:=0; i<threads; i++ {
+			go pool.worker()
+		}
+	}
+	return pool
+}
+
+// Splits the rows [start, end) into bands, runs fn on every band and waits for
+// all of them to finish. fn must only write to cells in the rows it is given.
+func (pool *workerPool) forRows(start, end int, fn func(start, end int)) {
+	if pool.jobs == nil {
+		fn(start, end)
+		return
+	}
+
+	bands := rowBands(start, end, pool.threads)
+	pool.wg.Add(len(bands))
+	for _, band := range bands {
+		pool.jobs <- poolJob{fn, band}
+	}
+	pool.wg.Wait()
+}
+
+func (pool *workerPool) worker() {
+	for job := range pool.jobs {
+		job.fn(job.band.start, job.band.end)
+		pool.wg.Done()
+	}
+}
+
+func (pool *workerPool) Close() {
+	if pool.jobs != nil {
+		close(pool.jobs)
+		pool.jobs = nil
+	}
+}
+
+
+//
+// Helper functions
+//
+
+// Splits the rows [start, end) into count bands of equal height except the last
+// one which may be slightly larger (same approach as gif.chunk)
+func rowBands(start, end, count int) []rowBand {
+	rows := end - start
+	if count > rows {
+		count = rows
+	}
+	if count < 1 {
+		return []rowBand{{start, end}}
+	}
+
+	height := rows / count
+	bands := make([]rowBand, count)
+	for i:=0; i<count-1; i++ {
+		bands[i] = rowBand{start, start+height}
+		start += height
+	}
+	bands[count-1] = rowBand{start, end}
+	return bands
+}
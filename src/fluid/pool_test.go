@@ -0,0 +1,75 @@
+package fluid
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// splitting the rows across the worker pool must not change a single bit of the
+// result, whatever the thread count
+func TestThreadsBitIdentical(t *testing.T) {
+	const W, H = 67, 45
+	solid, err := solidMask(W, H, "", []Obstacle{{Shape: "circle", X: 30, Y: 20, Radius: 6}}); if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := map[string]func(g *grid) [][]float32{
+		"advect": func(g *grid) [][]float32 {
+			d0, Vx, Vy := test_field(g, 1), test_field(g, 2), test_field(g, 3)
+			d := make([]float32, W*H)
+			advect(0, d, d0, Vx, Vy, 0.01, g)
+			return [][]float32{d}
+		},
+		"lin_solve_rb": func(g *grid) [][]float32 {
+			x, x0 := make([]float32, W*H), test_field(g, 1)
+			lin_solve(0, x, x0, 1, 4, 20, g, true, 0)
+			return [][]float32{x}
+		},
+	}
+	for _, solverName := range []string{"gauss-seidel", "jacobi", "cg", "multigrid"} {
+		solverName := solverName
+		steps["project/" + solverName] = func(g *grid) [][]float32 {
+			Vx, Vy := test_field(g, 1), test_field(g, 2)
+			p, div := make([]float32, W*H), make([]float32, W*H)
+			solver := pressureSolverCreate[float32](solverName, g, true)
+			project(Vx, Vy, p, div, 20, g, solver, 0, 4)
+			return [][]float32{Vx, Vy, p}
+		}
+	}
+
+	for name, step := range steps {
+		for _, mask := range [][]bool{nil, solid} {
+			run := func(threads int) [][]float32 {
+				pool := workerPoolCreate(threads)
+				defer pool.Close()
+				return step(gridCreate(W, H, pool, mask, Boundaries{}))
+			}
+			want := run(1)
+			for _, threads := range []int{2, 3, 7} {
+				t.Run(fmt.Sprintf("%s/obstacles=%v/threads=%d", name, mask != nil, threads), func(t *testing.T) {
+					for field, got := range run(threads) {
+						for index := range got {
+							if got[index] != want[field][index] {
+								t.Fatalf("field %d differs at %d: %g with 1 thread, %g with %d",
+									field, index, want[field][index], got[index], threads)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// random values in [-0.5, 0.5) on the interior cells
+func test_field(g *grid, seed int64) []float32 {
+	rng := rand.New(rand.NewSource(seed))
+	field := make([]float32, g.W*g.H)
+	for j:=1; j<g.H-1; j++ {
+		for i:=1; i<g.W-1; i++ {
+			field[ix(i, j, g.W)] = rng.Float32() - 0.5
+		}
+	}
+	return field
+}
@@ -0,0 +1,435 @@
+package fluid
+
+import (
+	"math"
+)
+
+// PressureSolver solves the pressure poisson equation inside project(). For every
+// interior fluid cell of the grid it solves
+//
+//     c*p[i,j] - a*(p[i+1,j] + p[i-1,j] + p[i,j+1] + p[i,j-1]) = div[i,j]
+//
+// using up to iter iterations (sweeps, cycles...), stopping early once the residual
+// (root mean square of div - A*p over the interior cells) drops below tolerance if
+// tolerance > 0. It reports the iterations run and the final residual.
+type PressureSolver[T Float] interface {
+	Solve(p, div []T, a, c T, iter int, tolerance T) SolveStats
+}
+
+// Gauss-Seidel (the original solver), uses the red-black ordering if selected
+type gaussSeidelSolver[T Float] struct {
+	grid     *grid
+	redBlack bool
+}
+
+// Jacobi iteration, every cell is updated from the previous iteration's values
+// so all rows can be split across the worker pool
+type jacobiSolver[T Float] struct {
+	grid    *grid
+	scratch []T
+}
+
+// Conjugate gradient preconditioned with the inverse of the matrix diagonal
+type conjugateGradientSolver[T Float] struct {
+	grid *grid
+	r    []T // residual
+	z    []T // preconditioned residual
+	d    []T // search direction
+	q    []T // A*d
+}
+
+// Geometric multigrid, every iteration is one V-cycle over a hierarchy of grids
+// which halve in size until one side of the coarsest grid is at most 4 cells long
+type multigridSolver[T Float] struct {
+	levels   []*multigridLevel[T]
+	singular bool // the system of the current Solve only fixes p up to a constant
+}
+
+type multigridLevel[T Float] struct {
+	grid *grid
+	x    []T // solution (correction on the coarser levels)
+	f    []T // right hand side
+	r    []T // residual
+}
+
+const MULTIGRID_SMOOTHING int = 2  // red-black Gauss-Seidel sweeps before and after each coarse grid correction
+const MULTIGRID_COARSEST int  = 4  // interior size of the coarsest multigrid level
+const MULTIGRID_COARSE_ITER int = 20 // Gauss-Seidel sweeps used to solve the coarsest level
+
+
+//
+// PressureSolver functions
+//
+
+// Creates the pressure solver called name for the grid. An empty name selects the
+// original Gauss-Seidel solver.
+func pressureSolverCreate[T Float](name string, g *grid, redBlack bool) PressureSolver[T] {
+	size := g.W * g.H
+	switch name {
+	case "", "gauss-seidel":
+		return &gaussSeidelSolver[T]{g, redBlack}
+	case "jacobi":
+		return &jacobiSolver[T]{g, make([]T, size)}
+	case "cg":
+		return &conjugateGradientSolver[T]{g,
+			make([]T, size), make([]T, size), make([]T, size), make([]T, size)}
+	case "multigrid":
+		return multigridSolverCreate[T](g)
+	default:
+		panic("Unknown pressure solver: " + name)
+	}
+}
+
+func (solver *gaussSeidelSolver[T]) Solve(p, div []T, a, c T, iter int, tolerance T) SolveStats {
+	return lin_solve(3, p, div, a, c, iter, solver.grid, solver.redBlack, tolerance)
+}
+
+func (solver *jacobiSolver[T]) Solve(p, div []T, a, c T, iter int, tolerance T) SolveStats {
+	g := solver.grid
+	W, H := g.W, g.H
+	cRecip := 1.0/c
+
+	stats := SolveStats{iter, 0}
+	src, dst := p, solver.scratch
+	for k:=0; k<iter; k++ {
+		g.pool.forRows(1, H-1, func(start, end int) {
+			for m:=start; m<end; m++ {
+				for j:=1; j<W-1; j++ {
+					dst[ix(j, m, W)] =
+						(div[ix(j, m, W)] +
+							a * (src[ix(j+1, m, W)] +
+								 src[ix(j-1, m, W)] +
+								 src[ix(j, m+1, W)] +
+								 src[ix(j, m-1, W)])) * cRecip
+				}
+			}
+		})
+		set_bnd(3, dst, g)
+		src, dst = dst, src
+
+		if tolerance > 0 && residual(src, div, a, c, g) < tolerance {
+			stats.Iterations = k+1
+			break
+		}
+	}
+
+	// after an odd number of iterations the solution is in the scratch array
+	if stats.Iterations % 2 == 1 {
+		copy(p, src)
+	}
+	stats.Residual = float32(residual(p, div, a, c, g))
+	return stats
+}
+
+func (solver *conjugateGradientSolver[T]) Solve(p, div []T, a, c T, iter int, tolerance T) SolveStats {
+	g := solver.grid
+	W, H := g.W, g.H
+	r, z, d, q := solver.r, solver.z, solver.d, solver.q
+
+	// r = div - A*p, z = M^-1 * r, d = z (obstacle cells aren't unknowns and stay 0)
+	apply_poisson(q, p, a, c, g)
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				index := ix(i, j, W)
+				if g.fluid(index) {
+					r[index] = div[index] - q[index]
+					z[index] = r[index] / poisson_diagonal(index, a, c, g)
+				} else {
+					r[index] = 0
+					z[index] = 0
+				}
+				d[index] = z[index]
+			}
+		}
+	})
+	delta := dot(r, z, g)
+
+	// r is updated along with p so the residual can be checked without applying A
+	cells := float64(fluidCells(g))
+	stats := SolveStats{}
+	for ; stats.Iterations<iter && delta > 0; stats.Iterations++ {
+		if tolerance > 0 && math.Sqrt(dot(r, r, g) / cells) < float64(tolerance) {
+			break
+		}
+
+		apply_poisson(q, d, a, c, g)
+		dq := dot(d, q, g)
+		if dq == 0 {
+			break
+		}
+		alpha := T(delta / dq)
+
+		// step along the search direction and update the residual
+		g.pool.forRows(1, H-1, func(start, end int) {
+			for j:=start; j<end; j++ {
+				for i:=1; i<W-1; i++ {
+					index := ix(i, j, W)
+					if !g.fluid(index) {
+						continue
+					}
+					p[index] += alpha * d[index]
+					r[index] -= alpha * q[index]
+					z[index] = r[index] / poisson_diagonal(index, a, c, g)
+				}
+			}
+		})
+
+		deltaNew := dot(r, z, g)
+		beta := T(deltaNew / delta)
+		delta = deltaNew
+
+		g.pool.forRows(1, H-1, func(start, end int) {
+			for j:=start; j<end; j++ {
+				for i:=1; i<W-1; i++ {
+					index := ix(i, j, W)
+					d[index] = z[index] + beta * d[index]
+				}
+			}
+		})
+	}
+
+	set_bnd(3, p, g)
+	stats.Residual = float32(residual(p, div, a, c, g))
+	return stats
+}
+
+func multigridSolverCreate[T Float](g *grid) *multigridSolver[T] {
+	// the finest level's solution and right hand side are the arrays passed to Solve
+	levels := []*multigridLevel[T]{{g, nil, nil, make([]T, g.W*g.H)}}
+	for g.W-2 > MULTIGRID_COARSEST && g.H-2 > MULTIGRID_COARSEST {
+		g = g.coarsen()
+		n := g.W * g.H
+		levels = append(levels, &multigridLevel[T]{g, make([]T, n), make([]T, n), make([]T, n)})
+	}
+	return &multigridSolver[T]{levels: levels}
+}
+
+func (solver *multigridSolver[T]) Solve(p, div []T, a, c T, iter int, tolerance T) SolveStats {
+	finest := solver.levels[0]
+	finest.x = p
+	finest.f = div
+
+	// With the validated stencil a constant can be added to p without changing A*p
+	// unless an edge holds the pressure at 0. The coarse levels then only have a
+	// solution if their right hand side sums to 0, so the mean is taken out of it
+	// and out of the corrections, otherwise the coarse solves pile up the constant.
+	solver.singular = c == 4*a && !finest.grid.bnd.open()
+
+	for k:=0; k<iter; k++ {
+		solver.vcycle(0, a, c)
+
+		if tolerance > 0 {
+			r := residual(p, div, a, c, finest.grid)
+			if r < tolerance {
+				return SolveStats{k+1, float32(r)}
+			}
+		}
+	}
+	return SolveStats{iter, float32(residual(p, div, a, c, finest.grid))}
+}
+
+// One V-cycle starting at the given level. On a grid twice as coarse the equation
+// keeps the same form with a/4 in front of the laplacian, the remaining (c-4a)*p
+// term is independent of the grid spacing.
+func (solver *multigridSolver[T]) vcycle(level int, a, c T) {
+	fine := solver.levels[level]
+
+	if level == len(solver.levels)-1 {
+		lin_solve_rb(3, fine.x, fine.f, a, c, MULTIGRID_COARSE_ITER, fine.grid)
+		return
+	}
+
+	// pre-smoothing
+	lin_solve_rb(3, fine.x, fine.f, a, c, MULTIGRID_SMOOTHING, fine.grid)
+
+	// residual restricted to the coarse grid becomes its right hand side
+	apply_poisson(fine.r, fine.x, a, c, fine.grid)
+	for index := range fine.r {
+		fine.r[index] = fine.f[index] - fine.r[index]
+	}
+
+	coarse := solver.levels[level+1]
+	restrict(coarse.f, fine.r, coarse.grid, fine.grid)
+	for index := range coarse.x {
+		coarse.x[index] = 0
+	}
+	if solver.singular {
+		remove_mean(coarse.f, coarse.grid)
+	}
+
+	solver.vcycle(level+1, a/4, c - 3*a)
+	if solver.singular {
+		remove_mean(coarse.x, coarse.grid)
+	}
+
+	// add the interpolated coarse grid correction
+	set_bnd(3, coarse.x, coarse.grid)
+	prolongate(fine.x, coarse.x, fine.grid, coarse.grid)
+	set_bnd(3, fine.x, fine.grid)
+
+	// post-smoothing
+	lin_solve_rb(3, fine.x, fine.f, a, c, MULTIGRID_SMOOTHING, fine.grid)
+}
+
+
+//
+// Helper functions
+//
+
+// out = A*x over the interior fluid cells (boundary cells of x are set first)
+func apply_poisson[T Float](out, x []T, a, c T, g *grid) {
+	W, H := g.W, g.H
+	set_bnd(3, x, g)
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				if !g.fluid(ix(i, j, W)) {
+					out[ix(i, j, W)] = 0
+					continue
+				}
+				out[ix(i, j, W)] = c * x[ix(i, j, W)] -
+					a * (x[ix(i+1, j, W)] +
+						 x[ix(i-1, j, W)] +
+						 x[ix(i, j+1, W)] +
+						 x[ix(i, j-1, W)])
+			}
+		}
+	})
+}
+
+// Diagonal of A. set_bnd puts part of a cell's own value into the walls and
+// obstacles next to it, which then show up as its neighbours (see grid.weight).
+func poisson_diagonal[T Float](index int, a, c T, g *grid) T {
+	return c - a * T(g.weight[index])
+}
+
+// Root mean square of div - A*p over the interior fluid cells, the boundary cells
+// of p must already be set. The rows are summed across the worker pool and added
+// up in row order so the result doesn't depend on the thread count.
+func residual[T Float](p, div []T, a, c T, g *grid) T {
+	W, H := g.W, g.H
+	rows := make([]float64, H)
+	g.pool.forRows(1, H-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			for i:=1; i<W-1; i++ {
+				if !g.fluid(ix(i, j, W)) {
+					continue
+				}
+				r := div[ix(i, j, W)] - (c * p[ix(i, j, W)] -
+					a * (p[ix(i+1, j, W)] +
+						 p[ix(i-1, j, W)] +
+						 p[ix(i, j+1, W)] +
+						 p[ix(i, j-1, W)]))
+				rows[j] += float64(r) * float64(r)
+			}
+		}
+	})
+	var sum float64
+	for _, row := range rows {
+		sum += row
+	}
+	cells := fluidCells(g)
+	if cells <= 0 {
+		return 0
+	}
+	return T(math.Sqrt(sum / float64(cells)))
+}
+
+// number of interior cells that aren't part of an obstacle
+func fluidCells(g *grid) int {
+	return (g.W-2) * (g.H-2) - len(g.obstacles)
+}
+
+// Dot product over the interior cells. It's accumulated sequentially in float64
+// so the result doesn't depend on how many threads are used.
+func dot[T Float](x, y []T, g *grid) float64 {
+	W, H := g.W, g.H
+	var sum float64
+	for j:=1; j<H-1; j++ {
+		for i:=1; i<W-1; i++ {
+			sum += float64(x[ix(i, j, W)]) * float64(y[ix(i, j, W)])
+		}
+	}
+	return sum
+}
+
+// Subtracts the average over the interior fluid cells from them. It's summed
+// sequentially like dot.
+func remove_mean[T Float](x []T, g *grid) {
+	W, H := g.W, g.H
+	var sum float64
+	for j:=1; j<H-1; j++ {
+		for i:=1; i<W-1; i++ {
+			if g.fluid(ix(i, j, W)) {
+				sum += float64(x[ix(i, j, W)])
+			}
+		}
+	}
+	cells := fluidCells(g)
+	if cells <= 0 {
+		return
+	}
+	mean := T(sum / float64(cells))
+	for j:=1; j<H-1; j++ {
+		for i:=1; i<W-1; i++ {
+			if g.fluid(ix(i, j, W)) {
+				x[ix(i, j, W)] -= mean
+			}
+		}
+	}
+}
+
+// Each coarse cell is the average of the (up to) 4 fine fluid cells it covers. On
+// odd grids the last coarse cell sticks out of the grid by half, the fine cells
+// it has outside count as 0 so the coarse grid sees the same total residual.
+func restrict[T Float](coarse, fine []T, gc, gf *grid) {
+	Wc, Hc, Wf, Hf := gc.W, gc.H, gf.W, gf.H
+	for J:=1; J<Hc-1; J++ {
+		for I:=1; I<Wc-1; I++ {
+			var sum T
+			count := 0
+			inside := 0
+			for j:=2*J-1; j<=2*J && j<Hf-1; j++ {
+				for i:=2*I-1; i<=2*I && i<Wf-1; i++ {
+					inside++
+					if gf.fluid(ix(i, j, Wf)) {
+						sum += fine[ix(i, j, Wf)]
+						count++
+					}
+				}
+			}
+			if count > 0 {
+				sum /= T(count + 4 - inside)
+			}
+			coarse[ix(I, J, Wc)] = sum
+		}
+	}
+	set_bnd(3, coarse, gc)
+}
+
+// Adds the bilinear interpolation of the coarse grid to the fine grid. Fine cell
+// 2I-1 sits a quarter of a coarse cell below coarse cell I and fine cell 2I a
+// quarter above, so the weights are 3/4 and 1/4 in each direction.
+func prolongate[T Float](fine, coarse []T, gf, gc *grid) {
+	Wf, Hf, Wc := gf.W, gf.H, gc.W
+	gf.pool.forRows(1, Hf-1, func(start, end int) {
+		for j:=start; j<end; j++ {
+			J0, ty := coarse_neighbour[T](j)
+			for i:=1; i<Wf-1; i++ {
+				I0, tx := coarse_neighbour[T](i)
+				fine[ix(i, j, Wf)] +=
+					(1-tx) * ((1-ty) * coarse[ix(I0, J0, Wc)] + ty * coarse[ix(I0, J0+1, Wc)]) +
+					tx * ((1-ty) * coarse[ix(I0+1, J0, Wc)] + ty * coarse[ix(I0+1, J0+1, Wc)])
+			}
+		}
+	})
+}
+
+// lower coarse cell used to interpolate fine cell i and the weight of the upper one
+func coarse_neighbour[T Float](i int) (int, T) {
+	if i % 2 == 1 {
+		return (i+1)/2 - 1, 0.75
+	}
+	return i/2, 0.25
+}
@@ -0,0 +1,87 @@
+package fluid
+
+import (
+	"math"
+)
+
+// volumeView draws a FluidCube3D into the 2D gif frames. It implements densityCube
+// so SimulationGIF and the BSP cacheCube treat it like a 2D fluid cube.
+//
+//   slice:    the cells of one slice through the cube
+//   mip:      maximum intensity projection, the densest cell along each ray
+//   raymarch: the cube as a cloud of glowing smoke which hides what's behind it
+//
+// Rays run along the chosen axis, the gif shows the other two axes.
+type volumeView struct {
+	cube    *FluidCube3D
+	render  string  // "slice", "mip" or "raymarch"
+	axis    string  // axis the view looks along: "x", "y" or "z"
+	slice   int     // slice drawn in slice mode
+	opacity float32 // how much light a unit of dye absorbs per cell when ray marching
+}
+
+
+//
+// volumeView functions
+//
+
+func volumeViewCreate(cube *FluidCube3D, opts *Options) *volumeView {
+	N := cube.Size()
+	slice := opts.Slice
+	if slice <= 0 || slice >= N-1 {
+		slice = N/2
+	}
+	return &volumeView{cube, opts.Render, opts.Axis, slice, opts.Opacity}
+}
+
+func (view *volumeView) Density(x, y int) float32 {
+	N := view.cube.Size()
+	switch view.render {
+	case "mip":
+		var max float32
+		for d:=1; d<N-1; d++ {
+			density := view.voxel(x, y, d)
+			if density > max {
+				max = density
+			}
+		}
+		return max
+	case "raymarch":
+		// front to back, every cell glows with the amount of light it absorbs
+		var light float32
+		transmittance := float32(1)
+		for d:=1; d<N-1 && transmittance > 0.01; d++ {
+			alpha := 1 - float32(math.Exp(float64(-view.opacity * view.voxel(x, y, d))))
+			light += transmittance * alpha
+			transmittance *= 1 - alpha
+		}
+		return light
+	default:
+		return view.voxel(x, y, view.slice)
+	}
+}
+
+func (view *volumeView) Solid(x, y int) bool {
+	return false
+}
+
+// dye channels are 2D only
+func (view *volumeView) Dye(channel, x, y int) float32 {
+	return 0
+}
+
+func (view *volumeView) DyeCount() int {
+	return 0
+}
+
+// density at pixel (x, y) of the view, depth cells away from the viewer
+func (view *volumeView) voxel(x, y, depth int) float32 {
+	switch view.axis {
+	case "x":
+		return view.cube.Density(depth, y, x)
+	case "y":
+		return view.cube.Density(x, depth, y)
+	default:
+		return view.cube.Density(x, y, depth)
+	}
+}
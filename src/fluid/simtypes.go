@@ -0,0 +1,446 @@
+package fluid
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+)
+
+// SimType sets up a simulation type. It's called before the cube is created with
+// the job's options, which it may change (turn the temperature on, add obstacles,
+// emitters or boundaries), and params, the job's "params" object (empty if there
+// isn't one). It returns the function that is run on every tick. Bad params should
+// panic like the rest of the job settings.
+type SimType func(opts *Options, width, height int, params json.RawMessage) func(*Simulation)
+
+// the simulation types a job can pick with simType
+var simTypes = map[string]SimType{
+	"random":             randomType,
+	"smoke-plume":        smokePlumeType,
+	"reaction-diffusion": reactionDiffusionType,
+	"emitters":           emittersType,
+	"jet":                jetType,
+	"vortex-pair":        vortexPairType,
+	"kelvin-helmholtz":   kelvinHelmholtzType,
+	"rayleigh-taylor":    rayleighTaylorType,
+	"karman-street":      karmanStreetType,
+}
+
+// Adds a simulation type jobs can select by name. Has to be called before the
+// simulations are created (e.g. from an init function), panics if the name is taken.
+func RegisterSimType(name string, simType SimType) {
+	if name == "" || simType == nil {
+		panic("RegisterSimType needs a name and a SimType")
+	}
+	if _, ok := simTypes[name]; ok {
+		panic("Simulation type registered twice: " + name)
+	}
+	simTypes[name] = simType
+}
+
+
+//
+// Simulation functions
+//
+
+// cube the simulation runs on (nil in 3D mode), for SimTypes outside the package
+func (sim *Simulation) Cube() *FluidCube {
+	return sim.cube
+}
+
+// cube of a 3D simulation (nil in 2D mode)
+func (sim *Simulation) Cube3D() *FluidCube3D {
+	return sim.cube3d
+}
+
+// current tick, starting at 0
+func (sim *Simulation) Tick() int {
+	return sim.tick
+}
+
+// random numbers of the simulation, seeded with the job's seed. SimTypes should
+// only use these so runs with the same seed are identical.
+func (sim *Simulation) Rand() *rand.Rand {
+	return sim.rng
+}
+
+
+//
+// SimType functions
+//
+
+func randomType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	if opts.Dimensions == 3 {
+		return random3D
+	}
+	return random
+}
+
+func smokePlumeType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	if opts.Dimensions == 3 {
+		return smokePlume3D
+	}
+	opts.Temperature = true
+
+	p := struct {
+		X      float32 `json:"x"`      // centre of the source
+		Y      float32 `json:"y"`
+		Radius float32 `json:"radius"` // half the width of the source
+		Amount float32 `json:"amount"` // dye per cell per tick
+		Heat   float32 `json:"heat"`   // temperature per cell per tick
+		Push   float32 `json:"push"`   // largest random sideways push per tick
+	}{float32(width/2), float32(height - height/8), float32(width/32 + 1), 0.5, 2, 0.5}
+	decode_params(params, &p)
+
+	return func(sim *Simulation) {
+		smokePlume(sim, int(p.X), int(p.Y), int(p.Radius), p.Amount, p.Heat, p.Push)
+	}
+}
+
+func reactionDiffusionType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("reaction-diffusion", opts)
+	opts.Reaction = true
+	return reactionDiffusion
+}
+
+// only the job's emitters add anything
+func emittersType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("emitters", opts)
+	return func(*Simulation) {}
+}
+
+// A jet of dye shoots out of a nozzle (an Emitter) and breaks up into eddies
+func jetType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("jet", opts)
+	validated_defaults(opts)
+	p := struct {
+		X      float32 `json:"x"`      // centre of the nozzle
+		Y      float32 `json:"y"`
+		Radius float32 `json:"radius"`
+		Speed  float32 `json:"speed"`  // velocity added per tick
+		Angle  float32 `json:"angle"`  // direction in degrees, 0 is to the right and 90 down
+		Amount float32 `json:"amount"` // dye per cell per tick
+		Wobble float32 `json:"wobble"` // largest random sideways push per tick
+	}{2, float32(height/2), float32(height/32 + 1), 2, 0, 0.5, 0.2}
+	decode_params(params, &p)
+
+	angle := float64(p.Angle) * math.Pi / 180
+	dirX, dirY := float32(math.Cos(angle)), float32(math.Sin(angle))
+	opts.Emitters = append(opts.Emitters, Emitter{
+		X: p.X, Y: p.Y, Radius: p.Radius, Amount: p.Amount, VX: p.Speed * dirX, VY: p.Speed * dirY})
+
+	return func(sim *Simulation) {
+		push := sim.rng.Float32() * negative(sim.rng) * p.Wobble
+		sim.cube.AddVelocity(int(p.X + p.Radius * dirX), int(p.Y + p.Radius * dirY), -push * dirY, push * dirX)
+	}
+}
+
+// Two vortices spinning in opposite directions push each other along, here upwards
+func vortexPairType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("vortex-pair", opts)
+	validated_defaults(opts)
+	p := struct {
+		X          float32 `json:"x"`          // centre between the vortices
+		Y          float32 `json:"y"`
+		Separation float32 `json:"separation"` // distance between the vortex centres
+		Radius     float32 `json:"radius"`     // size of each vortex core
+		Strength   float32 `json:"strength"`   // largest velocity in the cores
+		Amount     float32 `json:"amount"`     // dye in the middle of each core
+	}{float32(width/2), float32(height*3/4), float32(width/6), float32(width/16 + 1), 2, 1}
+	decode_params(params, &p)
+
+	return initially(func(sim *Simulation) {
+		cube := sim.cube
+		// left vortex turns anticlockwise on screen (y grows downwards), the right one clockwise
+		for channel, spin := range [2]float32{-1, 1} {
+			cx := p.X + (float32(channel) - 0.5) * p.Separation
+			for y:=1; y<cube.Height()-1; y++ {
+				for x:=1; x<cube.Width()-1; x++ {
+					dx, dy := (float32(x) - cx) / p.Radius, (float32(y) - p.Y) / p.Radius
+					core := float32(math.Exp(float64(-(dx*dx + dy*dy))))
+					cube.AddVelocity(x, y, -spin * p.Strength * dy * core, spin * p.Strength * dx * core)
+					add_dye(cube, channel, x, y, p.Amount * core)
+				}
+			}
+		}
+	}, nil)
+}
+
+// Two layers sliding past each other roll up into waves, the sides wrap around
+func kelvinHelmholtzType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("kelvin-helmholtz", opts)
+	validated_defaults(opts)
+	if opts.Boundary.Left.Type == "" && opts.Boundary.Right.Type == "" {
+		opts.Boundary.Left.Type, opts.Boundary.Right.Type = "periodic", "periodic"
+	}
+	p := struct {
+		Speed        float32 `json:"speed"`        // velocity of each layer, the top one moves right
+		Thickness    float32 `json:"thickness"`    // width of the shear layer in cells
+		Perturbation float32 `json:"perturbation"` // vertical velocity of the initial wave, relative to speed
+		Waves        int     `json:"waves"`        // wavelengths of the initial wave across the grid
+		Amount       float32 `json:"amount"`       // dye in each layer
+	}{2, float32(height/64 + 1), 0.3, 3, 0.5}
+	decode_params(params, &p)
+
+	return initially(func(sim *Simulation) {
+		cube := sim.cube
+		W, H := cube.Width(), cube.Height()
+		middle := float32(H) / 2
+		for y:=1; y<H-1; y++ {
+			across := (float32(y) - middle) / p.Thickness
+			vx := -p.Speed * float32(math.Tanh(float64(across)))
+			envelope := float32(math.Exp(float64(-across*across)))
+			for x:=1; x<W-1; x++ {
+				wave := float32(math.Sin(2 * math.Pi * float64(p.Waves) * float64(x-1) / float64(W-2)))
+				cube.AddVelocity(x, y, vx, p.Perturbation * p.Speed * wave * envelope)
+				// without a second dye channel only the top layer is dyed
+				if across < 0 {
+					add_dye(cube, 0, x, y, p.Amount)
+				} else if cube.DyeCount() > 1 {
+					add_dye(cube, 1, x, y, p.Amount)
+				}
+			}
+		}
+	}, nil)
+}
+
+// Heavy fluid on top of light fluid falls through it in mushroom shaped fingers.
+// The heavy fluid is the density, pulled down by the weight option.
+func rayleighTaylorType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("rayleigh-taylor", opts)
+	validated_defaults(opts)
+	opts.Temperature = true
+	if opts.Weight == 0 { opts.Weight = 1 }
+	p := struct {
+		Amount       float32 `json:"amount"`       // density of the heavy fluid
+		Perturbation float32 `json:"perturbation"` // height of the initial wave on the interface in cells
+		Waves        int     `json:"waves"`        // wavelengths of the wave across the grid
+	}{1, float32(height/32 + 1), 3}
+	decode_params(params, &p)
+
+	return initially(func(sim *Simulation) {
+		cube := sim.cube
+		W, H := cube.Width(), cube.Height()
+		for x:=1; x<W-1; x++ {
+			wave := float32(math.Cos(2 * math.Pi * float64(p.Waves) * float64(x-1) / float64(W-2)))
+			surface := float32(H) / 2 + p.Perturbation * wave
+			for y:=1; float32(y)<surface && y<H-1; y++ {
+				cube.AddDensity(x, y, p.Amount)
+			}
+		}
+	}, nil)
+}
+
+// Flow past a cylinder in a wind tunnel sheds a street of alternating vortices,
+// dye streaks coming in on the left show them. Needs a low viscosity.
+func karmanStreetType(opts *Options, width, height int, params json.RawMessage) func(*Simulation) {
+	only_2d("karman-street", opts)
+	validated_defaults(opts)
+	p := struct {
+		Speed   float32 `json:"speed"`   // velocity of the incoming flow
+		X       float32 `json:"x"`       // centre of the cylinder
+		Y       float32 `json:"y"`
+		Radius  float32 `json:"radius"`
+		Streaks int     `json:"streaks"` // number of dye streaks
+		Amount  float32 `json:"amount"`  // dye per streak per tick
+	}{1, float32(width/5), float32(height/2), float32(height/10 + 1), 8, 2}
+	decode_params(params, &p)
+
+	if opts.Boundary.Left.Type == "" {
+		opts.Boundary.Left = Edge{Type: "inflow", Vx: p.Speed}
+	}
+	if opts.Boundary.Right.Type == "" {
+		opts.Boundary.Right.Type = "outflow"
+	}
+	opts.Obstacles = append(opts.Obstacles, Obstacle{Shape: "circle", X: p.X, Y: p.Y, Radius: p.Radius})
+
+	// the tunnel starts out moving, with a small kick behind the cylinder so the
+	// wake doesn't stay symmetric
+	start := func(sim *Simulation) {
+		cube := sim.cube
+		W, H := cube.Width(), cube.Height()
+		for y:=1; y<H-1; y++ {
+			for x:=1; x<W-1; x++ {
+				if !cube.Solid(x, y) {
+					cube.AddVelocity(x, y, p.Speed, 0)
+				}
+			}
+		}
+		cube.AddVelocity(int(p.X + 2*p.Radius), int(p.Y), 0, p.Speed)
+	}
+	return initially(start, func(sim *Simulation) {
+		// a few cells in from the inflow edge, which copies the first column into the
+		// ghost cells so dye added right next to it would pile up
+		H := sim.cube.Height()
+		for s:=0; s<p.Streaks; s++ {
+			add_dye(sim.cube, s, 4, 1 + (2*s + 1) * (H-2) / (2*p.Streaks), p.Amount)
+		}
+	})
+}
+
+
+//
+// update functions
+//
+
+func random(sim *Simulation) {
+	// Generate random coordinates + random density
+	randX := int(sim.rng.Int31n(int32(sim.cube.Width())-1))
+	randY := int(sim.rng.Int31n(int32(sim.cube.Height())-1))
+	randD := sim.rng.Float32()*200
+
+	// Repeat 4x so effect is more noticeable
+	for j:=0; j<4; j++ {
+		randXVelocity := sim.rng.Float32()*negative(sim.rng)*2
+		randYVelocity := sim.rng.Float32()*negative(sim.rng)*2
+
+		// Add some dye + velocity to a random area of the fluid cube, the dye
+		// channels take turns if there are any
+		if dyes := sim.cube.DyeCount(); dyes > 0 {
+			sim.cube.AddDye(sim.tick % dyes, randX, randY, randD)
+		} else {
+			sim.cube.AddDensity(randX, randY, randD)
+		}
+		sim.cube.AddVelocity(randX, randY, randXVelocity, randYVelocity)
+
+		// Add some velocity to the center of the fluid cube
+		sim.cube.AddVelocity(sim.cube.Width()/2, sim.cube.Height()/2, randXVelocity, randYVelocity)
+	}
+}
+
+// Hot, dyed fluid is released from a small source around (x, y) and rises (needs
+// a reasonably large dt, e.g. "dt": 0.01)
+func smokePlume(sim *Simulation, sourceX, sourceY, radius int, amount, heat, push float32) {
+	// with dye channels the source is split into one stripe per channel
+	dyes := sim.cube.DyeCount()
+	for x:=sourceX-radius; x<=sourceX+radius; x++ {
+		if dyes > 0 {
+			sim.cube.AddDye((x - sourceX + radius) * dyes / (2*radius + 1), x, sourceY, amount)
+		} else {
+			sim.cube.AddDensity(x, sourceY, amount)
+		}
+		sim.cube.AddTemperature(x, sourceY, heat)
+	}
+
+	// small random sideways push so the plume doesn't stay perfectly symmetric
+	sim.cube.AddVelocity(sourceX, sourceY, sim.rng.Float32()*negative(sim.rng)*push, 0)
+}
+
+// Drops a small square of the second species into the first one every 20 ticks
+// and stirs it a little, the Gray-Scott reaction grows it into a pattern
+func reactionDiffusion(sim *Simulation) {
+	if sim.tick % 20 != 0 {
+		return
+	}
+	width, height := sim.cube.Width(), sim.cube.Height()
+	size := width
+	if height < size {
+		size = height
+	}
+	radius := size/32 + 1
+	// too small for a drop that doesn't touch the edges
+	if size - 2*radius - 2 <= 0 {
+		return
+	}
+	x := radius + 1 + int(sim.rng.Int31n(int32(width - 2*radius - 2)))
+	y := radius + 1 + int(sim.rng.Int31n(int32(height - 2*radius - 2)))
+
+	for j:=y-radius; j<=y+radius; j++ {
+		for i:=x-radius; i<=x+radius; i++ {
+			sim.cube.AddDye(1, i, j, 0.25)
+			sim.cube.AddDye(0, i, j, -0.5)
+		}
+	}
+	sim.cube.AddVelocity(x, y, sim.rng.Float32()*negative(sim.rng), sim.rng.Float32()*negative(sim.rng))
+}
+
+// 3D version of random
+func random3D(sim *Simulation) {
+	N := sim.cube3d.Size()
+	randX := int(sim.rng.Int31n(int32(N)-1))
+	randY := int(sim.rng.Int31n(int32(N)-1))
+	randZ := int(sim.rng.Int31n(int32(N)-1))
+	randD := sim.rng.Float32()*200
+
+	for j:=0; j<4; j++ {
+		randXVelocity := sim.rng.Float32()*negative(sim.rng)*2
+		randYVelocity := sim.rng.Float32()*negative(sim.rng)*2
+		randZVelocity := sim.rng.Float32()*negative(sim.rng)*2
+
+		sim.cube3d.AddDensity(randX, randY, randZ, randD)
+		sim.cube3d.AddVelocity(randX, randY, randZ, randXVelocity, randYVelocity, randZVelocity)
+		sim.cube3d.AddVelocity(N/2, N/2, N/2, randXVelocity, randYVelocity, randZVelocity)
+	}
+}
+
+// 3D version of smokePlume. FluidCube3D has no temperature field so the dye is
+// pushed upwards directly.
+func smokePlume3D(sim *Simulation) {
+	N := sim.cube3d.Size()
+	radius := N/32 + 1
+	sourceY := N - N/8
+
+	for z:=N/2-radius; z<=N/2+radius; z++ {
+		for x:=N/2-radius; x<=N/2+radius; x++ {
+			sim.cube3d.AddDensity(x, sourceY, z, 0.5)
+			sim.cube3d.AddVelocity(x, sourceY, z, 0, -0.5, 0)
+		}
+	}
+
+	sim.cube3d.AddVelocity(N/2, sourceY, N/2, sim.rng.Float32()*negative(sim.rng)*0.5, 0, sim.rng.Float32()*negative(sim.rng)*0.5)
+}
+
+
+//
+// Helper functions
+//
+
+// Reads a SimType's params into p, which holds the defaults. Unknown fields are
+// ignored like in the rest of the job.
+func decode_params(params json.RawMessage, p interface{}) {
+	if len(params) == 0 {
+		return
+	}
+	err := json.Unmarshal(params, p); if err != nil {
+		panic("Bad simulation params: " + err.Error())
+	}
+}
+
+func only_2d(simType string, opts *Options) {
+	if opts.Dimensions == 3 {
+		panic("Unknown 3D simulation type: " + simType)
+	}
+}
+
+// The presets below smoke-plume default to the validated physics and the conjugate
+// gradient solver, the legacy stencil loses a little dye + momentum every tick which
+// stops their instabilities from growing. multigrid still blows up behind obstacles
+func validated_defaults(opts *Options) {
+	if opts.Physics == "" { opts.Physics = "validated" }
+	if opts.Solver == "" { opts.Solver = "cg" }
+}
+
+// Update function that runs setup the first time it's called and update (if it
+// isn't nil) every time. The initial state is only added once even if the update
+// function is repeated within a tick.
+func initially(setup, update func(*Simulation)) func(*Simulation) {
+	done := false
+	return func(sim *Simulation) {
+		if !done {
+			setup(sim)
+			done = true
+		}
+		if update != nil {
+			update(sim)
+		}
+	}
+}
+
+// adds to a dye channel, the channels wrap around and without any it's the density
+func add_dye(cube *FluidCube, channel, x, y int, amount float32) {
+	if dyes := cube.DyeCount(); dyes > 0 {
+		cube.AddDye(channel % dyes, x, y, amount)
+	} else {
+		cube.AddDensity(x, y, amount)
+	}
+}
@@ -1,30 +1,50 @@
 package fluid
 
 import (
+	"bufio"
+	"fmt"
 	"image"
 	"proj3/gif"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 	"image/color"
 )
 
 
 const FLOAT32_MIN float32 = 0.0000001
+const DEFAULT_FADE_OUT int = 50
+
+var OBSTACLE_COLOR = color.RGBA64{0x4000, 0x6000, 0xA000, 0xFFFF} // colour solid cells are drawn in
 
 
 type Simulation struct {
-	cube 			*FluidCube		  // fluidCube that handles the actual simulation
+	cube 			*FluidCube		  // fluidCube that handles the actual simulation (nil in 3D mode)
+	cube3d 			*FluidCube3D	  // handles the simulation in 3D mode instead (nil in 2D mode)
+	view 			densityCube		  // what gets drawn into the gif: the 2D cube or a view of the 3D one
 	cubePrevState 	*cacheCube		  // prev tick of fluidCube, enables simulaneous writing of prev tick and updating current tick (only used in BSP Mode)
 	length  		int				  // how long to simulate for
-	simType 		string 			  // simulation type: "random"
+	simType 		string 			  // simulation type, a name in simTypes (see simtypes.go)
 	update  		func(*Simulation) // update function that is run on every tick
-	fadeOut 		bool   			  // don't add dye for the last 50 ticks
+	emitters		[]Emitter		  // sources run every tick on top of update (2D only)
+	fadeOutTicks	int				  // don't add dye in this many ticks at the end (0 if fadeOut is off)
 	tick			int				  // current tick
 	repeat			int				  // how many times to run the update function every tick
+	timesteps		[]float32		  // dt used by the fluid cube on every tick
+	dyes			[]Dye			  // colours of the cube's dye channels
+	tracers			*tracerSet		  // tracer particles drawn on top of the frames (nil if there are none)
+	tracersPrevState []float32		  // tracer layer of the prev tick (only used in BSP Mode)
+	diagnostics		*diagnosticsLog	  // file the cube's diagnostics are written to every tick (nil if none)
+	abortOnNaN		bool			  // panic when the diagnostics aren't finite
+	rng				*rand.Rand		  // random numbers of the update functions, seeded with Options.Seed
 }
 
 type SimulationGIF struct {
-	GIF 	*gif.GIF
-	sim		*Simulation
+	GIF 	  *gif.GIF
+	sim		  *Simulation
+	dtPath	  string	 // file Save writes the dt of every frame to (empty unless adaptiveDt is on)
 }
 
 
@@ -32,27 +52,82 @@ type SimulationGIF struct {
 // Simulation functions
 //
 
-func FluidSimulationCreate(size, length int, diffusion, viscosity float32, simType string, repeat int, fadeOut bool, bspMode bool) *Simulation {
-	f := FluidCubeCreate(size, diffusion, viscosity, FLOAT32_MIN)
-
-	var update func(*Simulation)
-	switch simType {
-	case "random":
-		update = random
-	default:
+func FluidSimulationCreate(width, height, length int, diffusion, viscosity float32, simType string, repeat int, fadeOut bool, bspMode bool, threadCount int, opts Options) *Simulation {
+	if simType == "" && (len(opts.Emitters) > 0 || opts.InitialDensity != "" || opts.InitialVelocity != "") {
+		simType = "emitters"
+	}
+	create, ok := simTypes[simType]; if !ok {
+		if opts.Dimensions == 3 {
+			panic("Unknown 3D simulation type: " + simType)
+		}
 		panic("Unknown simulation type: " + simType)
 	}
+	// every simulation has its own random numbers so jobs running at the same time
+	// don't take them from each other, the same seed always gives the same gif
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	update := create(&opts, width, height, opts.Params)
+
+	opts.initialize()
+	var f *FluidCube
+	var f3 *FluidCube3D
+	var view densityCube
+	var dyes []Dye
+	var tracers *tracerSet
+	if opts.Dimensions == 3 {
+		if width != height {
+			panic("3D simulations have to be square")
+		}
+		f3 = FluidCube3DCreate(width, diffusion, viscosity, opts.Dt, threadCount, opts)
+		view = volumeViewCreate(f3, &opts)
+	} else {
+		f = FluidCubeCreate(width, height, diffusion, viscosity, opts.Dt, threadCount, opts)
+		view = f
+		dyes = opts.Dyes
+		if opts.Tracers.Seed != "" {
+			tracers = tracerSetCreate(f, opts.Tracers, opts.Boundary, rng)
+		}
+	}
+
+	var log *diagnosticsLog
+	if opts.Diagnostics != "" && f != nil {
+		var err error
+		log, err = diagnosticsLogCreate(opts.Diagnostics); if err != nil {
+			panic(err)
+		}
+	}
 
 	if repeat <= 0 {
 		repeat = 1
 	}
 
+	// a fade out longer than half the job would swallow short jobs whole
+	fadeOutTicks := opts.FadeOutTicks
+	if fadeOut && fadeOutTicks <= 0 {
+		fadeOutTicks = DEFAULT_FADE_OUT
+	}
+	if fadeOutTicks > length/2 {
+		fadeOutTicks = length/2
+	}
+	if fadeOutTicks < 0 {
+		fadeOutTicks = 0
+	}
+
 	var prev *cacheCube
+	var prevTracers []float32
 	if bspMode {
-		prev = cacheCubeCreate(size)
+		prev = cacheCubeCreate(width, height, view.DyeCount())
+		if tracers != nil {
+			prevTracers = make([]float32, len(tracers.layer))
+			copy(prevTracers, tracers.layer)
+		}
 	}
 
-	return &Simulation{f, prev, length, simType, update, fadeOut, 0, repeat}
+	return &Simulation{f, f3, view, prev, length, simType, update, opts.Emitters, fadeOutTicks, 0, repeat, make([]float32, 0, length), dyes, tracers, prevTracers, log, opts.AbortOnNaN, rng}
 }
 
 func (sim *Simulation) Run() {
@@ -66,7 +141,36 @@ func (sim *Simulation) Run() {
 }
 
 func (sim *Simulation) CubeStep() {
+	if sim.cube3d != nil {
+		sim.cube3d.Step()
+		sim.timesteps = append(sim.timesteps, sim.cube3d.Dt())
+		return
+	}
 	sim.cube.Step()
+	sim.timesteps = append(sim.timesteps, sim.cube.Dt())
+
+	// measuring sweeps the whole grid, only do it if something reads the result
+	if sim.diagnostics != nil || sim.abortOnNaN {
+		diagnostics := sim.cube.Diagnostics()
+		if sim.diagnostics != nil {
+			err := sim.diagnostics.Write(sim.tick, sim.cube.Dt(), diagnostics); if err != nil {
+				panic(err)
+			}
+		}
+		if sim.abortOnNaN && !diagnostics.Finite() {
+			sim.Close()
+			panic(fmt.Sprintf("Simulation blew up at tick %d: %+v", sim.tick, diagnostics))
+		}
+	}
+
+	if sim.tracers != nil {
+		sim.tracers.Advance(sim.cube)
+	}
+}
+
+// dt chosen for every tick simulated so far (they only differ in adaptive mode)
+func (sim *Simulation) Timesteps() []float32 {
+	return sim.timesteps
 }
 
 func (sim *Simulation) NextTick() {
@@ -79,39 +183,49 @@ func (sim *Simulation) Step() {
 }
 
 func (sim *Simulation) Update() {
-	// If fadeOut option selected, don't add any dye for the last 50 ticks
-	if !(sim.fadeOut && sim.tick > sim.length-50) {
+	// If fadeOut option selected, don't add any dye for the last fadeOutTicks ticks
+	if !(sim.fadeOutTicks > 0 && sim.tick > sim.length-sim.fadeOutTicks) {
 
 		// scale number of times update is called by repeat amount
 		for i:=0; i<sim.repeat; i++ {
 			sim.update(sim)
 		}
+
+		// the emitters add the same amount every tick whatever repeat is
+		emitters(sim)
+	}
+}
+
+// stop the fluid cube's worker goroutines once the simulation is done, and finish
+// the diagnostics file
+func (sim *Simulation) Close() {
+	if sim.cube3d != nil {
+		sim.cube3d.Close()
+		return
+	}
+	sim.cube.Close()
+	if sim.diagnostics != nil {
+		err := sim.diagnostics.Close(); if err != nil {
+			panic(err)
+		}
+		sim.diagnostics = nil
 	}
 }
 
 // copy FluidCube's density slice values to prevState's density slice
 func (sim *Simulation) UpdatePrevState() {
-	sim.cubePrevState.SaveState(sim.cube)
+	sim.cubePrevState.SaveState(sim.view)
+	if sim.tracers != nil {
+		copy(sim.tracersPrevState, sim.tracers.layer)
+	}
 }
 
-func random(sim *Simulation) {
-	// Generate random coordinates + random density
-	randX := int(rand.Int31n(int32(sim.cube.size)-1))
-	randY := int(rand.Int31n(int32(sim.cube.size)-1))
-	randD := rand.Float32()*200
-
-	// Repeat 4x so effect is more noticeable
-	for j:=0; j<4; j++ {
-		randXVelocity := rand.Float32()*negative()*2
-		randYVelocity := rand.Float32()*negative()*2
-
-		// Add some dye + velocity to a random area of the fluid cube
-		sim.cube.AddDensity(randX, randY, randD)
-		sim.cube.AddVelocity(randX, randY, randXVelocity, randYVelocity)
-				
-		// Add some velocity to the center of the fluid cube
-		sim.cube.AddVelocity(sim.cube.size/2, sim.cube.size/2, randXVelocity, randYVelocity)
+// current tracer layer (nil if there are no tracers)
+func (sim *Simulation) tracerLayer() []float32 {
+	if sim.tracers == nil {
+		return nil
 	}
+	return sim.tracers.layer
 }
 
 
@@ -119,10 +233,17 @@ func random(sim *Simulation) {
 // SimulationGIF functions
 //
 
-func FluidSimulationGIFCreate(size int, frames uint, delay int, simType string, diffusion, viscosity float32, repeat int, fadeOut bool, outPath string, threadCount int, bspMode bool) *SimulationGIF {
-	g := gif.NewGIF(size, size, delay, frames, outPath, threadCount)
-	s := FluidSimulationCreate(size, int(frames), diffusion, viscosity, simType, repeat, fadeOut, bspMode)
-	return &SimulationGIF{g, s}
+func FluidSimulationGIFCreate(width, height int, frames uint, delay int, simType string, diffusion, viscosity float32, repeat int, fadeOut bool, outPath string, threadCount int, bspMode bool, opts Options) *SimulationGIF {
+	g := gif.NewGIF(width, height, delay, frames, outPath, threadCount)
+	s := FluidSimulationCreate(width, height, int(frames), diffusion, viscosity, simType, repeat, fadeOut, bspMode, threadCount, opts)
+
+	// in adaptive mode the frames are different lengths of time apart, the dt of
+	// each goes next to the gif: out.gif -> out.dt.csv
+	var dtPath string
+	if opts.AdaptiveDt {
+		dtPath = strings.TrimSuffix(outPath, filepath.Ext(outPath)) + ".dt.csv"
+	}
+	return &SimulationGIF{g, s, dtPath}
 }
 
 // Lazy initialization of GIF frames for improved performance (in theory)
@@ -139,14 +260,31 @@ func (sg *SimulationGIF) WriteFrame() {
 	minBounds := image.Point{X:0, Y:0}
 	maxBounds := sg.GIF.Size()
 	rect := image.Rectangle{ minBounds, maxBounds}
-	sg.writeFrameChunk(sg.sim.cube, rect)
+	sg.writeFrameChunk(sg.sim.view, sg.sim.tracerLayer(), rect)
 }
 
-func (sg *SimulationGIF) writeFrameChunk(cube densityCube, chunk image.Rectangle) {
+// tracers is the tracer layer drawn on top of the cube (nil if there are none)
+func (sg *SimulationGIF) writeFrameChunk(cube densityCube, tracers []float32, chunk image.Rectangle) {
+	W := sg.GIF.Size().X
 	for x:=chunk.Min.X; x<chunk.Max.X; x++ {
 		for y:=chunk.Min.Y; y<chunk.Max.Y; y++ {
-			density := cube.Density(x, y)
-			sg.CurrentFrame().Set(x, y, brightness(density))
+			if cube.Solid(x, y) {
+				sg.CurrentFrame().Set(x, y, OBSTACLE_COLOR)
+				continue
+			}
+
+			var pixel color.RGBA64
+			if len(sg.sim.dyes) > 0 {
+				pixel = composite(cube, sg.sim.dyes, x, y)
+			} else {
+				pixel = brightness(cube.Density(x, y))
+			}
+			if tracers != nil {
+				if intensity := tracers[ix(x, y, W)]; intensity > 0 {
+					pixel = overlay(pixel, sg.sim.tracers.opts.Color, intensity)
+				}
+			}
+			sg.CurrentFrame().Set(x, y, pixel)
 		}
 	}
 }
@@ -164,8 +302,23 @@ func (sg *SimulationGIF) Run() {
 	}
 }
 
+// saves the gif and, in adaptive mode, the dt of every frame
 func (sg *SimulationGIF) Save() error {
-	return sg.GIF.Save()
+	err := sg.GIF.Save(); if err != nil {
+		return err
+	}
+	if sg.dtPath == "" {
+		return nil
+	}
+	return writeTimesteps(sg.dtPath, sg.sim.Timesteps())
+}
+
+func (sg *SimulationGIF) Timesteps() []float32 {
+	return sg.sim.Timesteps()
+}
+
+func (sg *SimulationGIF) Close() {
+	sg.sim.Close()
 }
 
 
@@ -173,6 +326,23 @@ func (sg *SimulationGIF) Save() error {
 // Helper functions
 //
 
+// writes a "frame,dt" CSV line for every tick
+func writeTimesteps(path string, timesteps []float32) error {
+	file, err := os.Create(path); if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "frame,dt")
+	for frame, dt := range timesteps {
+		fmt.Fprintf(writer, "%d,%g\n", frame, dt)
+	}
+	err = writer.Flush(); if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func scale(f float32) uint16 {
 	f = f*65535
 	if f < 0 {
@@ -189,8 +359,8 @@ func brightness(amt float32) color.RGBA64 {
 	return color.RGBA64{x, x, x, x}
 }
 
-func negative() float32 {
-	rint := rand.Int31n(2) 
+func negative(rng *rand.Rand) float32 {
+	rint := rng.Int31n(2)
 	if rint == 0 {
 		return -1
 	} else {
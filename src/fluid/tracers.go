@@ -0,0 +1,257 @@
+package fluid
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+const DEFAULT_TRACERS int = 100
+
+// Tracers are massless particles which are carried along by the fluid without
+// changing it. They're drawn on top of the density so the gif shows how the fluid
+// moves and not just where the dye is. 2D only.
+//
+//   grid:   evenly spaced over the whole grid
+//   random: scattered randomly over the grid
+//   line:   evenly spaced along the line from (x0, y0) to (x1, y1)
+type Tracers struct {
+	Seed       string     `json:"seed"`       // how the tracers are placed: "grid", "random" or "line", no tracers if empty
+	Count      int        `json:"count"`      // how many tracers are seeded (default 100)
+	Line       [4]float32 `json:"line"`       // x0, y0, x1, y1 of the "line" seeding, in cells
+	Integrator string     `json:"integrator"` // "rk2" (default) or "rk4"
+	Trail      int        `json:"trail"`      // draw a trail of the last this many ticks behind every tracer, 0 draws dots
+	Color      [3]float32 `json:"color"`      // red, green + blue between 0 and 1 (default yellow)
+}
+
+// tracerSet moves the tracers through the velocity of a FluidCube and draws them
+// into a layer of pixel intensities which writeFrameChunk puts on top of the frame
+type tracerSet struct {
+	opts    Tracers
+	width   int
+	height  int
+	bnd     Boundaries   // periodic edges wrap the tracers around
+	x, y    []float32    // current position of every tracer, in cells (cell centres are whole numbers)
+	history [][2]float32 // last Trail+1 positions of every tracer, Trail+1 entries per tracer
+	head    int          // entry of history that has the current positions
+	filled  int          // entries of history that have been written to
+	layer   []float32    // how much of the tracer colour every pixel gets, 0 to 1
+}
+
+
+//
+// Tracers functions
+//
+
+// fills in defaults and panics on unknown settings
+func (opts *Tracers) initialize() {
+	switch opts.Seed {
+	case "", "grid", "random", "line":
+	default:
+		panic("Unknown tracer seeding: " + opts.Seed)
+	}
+	switch opts.Integrator {
+	case "", "rk2", "rk4":
+	default:
+		panic("Unknown tracer integrator: " + opts.Integrator)
+	}
+	if opts.Count <= 0 { opts.Count = DEFAULT_TRACERS }
+	if opts.Trail < 0 { opts.Trail = 0 }
+	if opts.Color == [3]float32{} { opts.Color = [3]float32{1, 1, 0} }
+}
+
+
+//
+// tracerSet functions
+//
+
+// Seeds the tracers, the ones that would start inside an obstacle are left out. rng
+// places the "random" ones.
+func tracerSetCreate(cube *FluidCube, opts Tracers, bnd Boundaries, rng *rand.Rand) *tracerSet {
+	W, H := cube.Width(), cube.Height()
+	ts := &tracerSet{opts: opts, width: W, height: H, bnd: bnd, layer: make([]float32, W*H)}
+
+	seed := func(x, y float32) {
+		x, y = ts.clamp(x, y)
+		if !cube.Solid(int(x + 0.5), int(y + 0.5)) {
+			ts.x = append(ts.x, x)
+			ts.y = append(ts.y, y)
+		}
+	}
+
+	// the interior cells cover [0.5, W-1.5) x [0.5, H-1.5)
+	switch opts.Seed {
+	case "grid":
+		cols := int(math.Round(math.Sqrt(float64(opts.Count * (W-2)) / float64(H-2))))
+		if cols < 1 { cols = 1 }
+		rows := (opts.Count + cols - 1) / cols
+		for b:=0; b<rows; b++ {
+			for a:=0; a<cols; a++ {
+				seed(0.5 + (float32(a) + 0.5) * float32(W-2) / float32(cols),
+					0.5 + (float32(b) + 0.5) * float32(H-2) / float32(rows))
+			}
+		}
+	case "random":
+		for i:=0; i<opts.Count; i++ {
+			seed(0.5 + rng.Float32() * float32(W-2), 0.5 + rng.Float32() * float32(H-2))
+		}
+	case "line":
+		x0, y0, x1, y1 := opts.Line[0], opts.Line[1], opts.Line[2], opts.Line[3]
+		for i:=0; i<opts.Count; i++ {
+			t := float32(0.5)
+			if opts.Count > 1 {
+				t = float32(i) / float32(opts.Count - 1)
+			}
+			seed(x0 + t * (x1 - x0), y0 + t * (y1 - y0))
+		}
+	}
+
+	ts.history = make([][2]float32, len(ts.x) * (opts.Trail + 1))
+	ts.record()
+	ts.draw()
+	return ts
+}
+
+// Moves every tracer through the cube's velocity over the cube's last timestep.
+// advect moves the fluid by dt * (N-2) * velocity cells, the tracers move the same.
+func (ts *tracerSet) Advance(cube *FluidCube) {
+	N := ts.width
+	if ts.height > N {
+		N = ts.height
+	}
+	h := cube.Dt() * float32(N-2)
+
+	velocity := func(x, y float32) (float32, float32) {
+		x, y = ts.clamp(x, y)
+		return tracer_velocity(cube, x, y)
+	}
+
+	for i := range ts.x {
+		x, y := ts.x[i], ts.y[i]
+		var dx, dy float32
+		if ts.opts.Integrator == "rk4" {
+			k1x, k1y := velocity(x, y)
+			k2x, k2y := velocity(x + 0.5*h*k1x, y + 0.5*h*k1y)
+			k3x, k3y := velocity(x + 0.5*h*k2x, y + 0.5*h*k2y)
+			k4x, k4y := velocity(x + h*k3x, y + h*k3y)
+			dx = h / 6 * (k1x + 2*k2x + 2*k3x + k4x)
+			dy = h / 6 * (k1y + 2*k2y + 2*k3y + k4y)
+		} else {
+			k1x, k1y := velocity(x, y)
+			k2x, k2y := velocity(x + 0.5*h*k1x, y + 0.5*h*k1y)
+			dx, dy = h*k2x, h*k2y
+		}
+
+		// tracers can't enter obstacles, they stop in front of them
+		newX, newY := ts.clamp(x + dx, y + dy)
+		if !cube.Solid(int(newX + 0.5), int(newY + 0.5)) {
+			ts.x[i], ts.y[i] = newX, newY
+		}
+	}
+
+	ts.head = (ts.head + 1) % (ts.opts.Trail + 1)
+	ts.record()
+	ts.draw()
+}
+
+// copies the current positions into the history
+func (ts *tracerSet) record() {
+	length := ts.opts.Trail + 1
+	for i := range ts.x {
+		ts.history[i*length + ts.head] = [2]float32{ts.x[i], ts.y[i]}
+	}
+	if ts.filled < length {
+		ts.filled++
+	}
+}
+
+// Redraws the layer. Dots are a single pixel, trails are lines through the
+// recorded positions which fade out towards the oldest one.
+func (ts *tracerSet) draw() {
+	for index := range ts.layer {
+		ts.layer[index] = 0
+	}
+
+	length := ts.opts.Trail + 1
+	for i := range ts.x {
+		ts.plot(ts.x[i], ts.y[i], 1)
+		for age:=1; age<ts.filled; age++ {
+			newer := ts.history[i*length + (ts.head - age + 1 + length) % length]
+			older := ts.history[i*length + (ts.head - age + length) % length]
+			ts.line(newer, older, 1 - float32(age) / float32(length))
+		}
+	}
+}
+
+// Draws a line between 2 tracer positions, segments which wrapped around a periodic
+// edge are skipped
+func (ts *tracerSet) line(from, to [2]float32, intensity float32) {
+	dx, dy := to[0] - from[0], to[1] - from[1]
+	if abs(dx) > float32(ts.width) / 2 || abs(dy) > float32(ts.height) / 2 {
+		return
+	}
+	steps := int(math.Ceil(float64(math.Max(float64(abs(dx)), float64(abs(dy))))))
+	for s:=1; s<=steps; s++ {
+		t := float32(s) / float32(steps)
+		ts.plot(from[0] + t*dx, from[1] + t*dy, intensity)
+	}
+}
+
+// brightens the pixel a position is in, overlapping tracers keep the brightest
+func (ts *tracerSet) plot(x, y, intensity float32) {
+	px, py := int(x + 0.5), int(y + 0.5)
+	if px < 0 || py < 0 || px >= ts.width || py >= ts.height {
+		return
+	}
+	index := ix(px, py, ts.width)
+	if intensity > ts.layer[index] {
+		ts.layer[index] = intensity
+	}
+}
+
+// Keeps a position inside the interior cells, periodic axes wrap around instead
+func (ts *tracerSet) clamp(x, y float32) (float32, float32) {
+	Wfloat, Hfloat := float32(ts.width), float32(ts.height)
+	if ts.bnd.periodicX() {
+		x = wrap(x + 0.5, Wfloat) - 0.5
+	} else {
+		if !(x >= 0.5) { x = 0.5 }
+		if x > Wfloat - 1.5 { x = Wfloat - 1.5 }
+	}
+	if ts.bnd.periodicY() {
+		y = wrap(y + 0.5, Hfloat) - 0.5
+	} else {
+		if !(y >= 0.5) { y = 0.5 }
+		if y > Hfloat - 1.5 { y = Hfloat - 1.5 }
+	}
+	return x, y
+}
+
+
+//
+// Helper functions
+//
+
+// Bilinear interpolation of the cube's velocity at a position between the cell
+// centres, the position has to be inside the interior cells
+func tracer_velocity(cube *FluidCube, x, y float32) (float32, float32) {
+	i0, j0 := int(floorf(x)), int(floorf(y))
+	s, t := x - float32(i0), y - float32(j0)
+
+	vx00, vy00 := cube.Velocity(i0, j0)
+	vx10, vy10 := cube.Velocity(i0+1, j0)
+	vx01, vy01 := cube.Velocity(i0, j0+1)
+	vx11, vy11 := cube.Velocity(i0+1, j0+1)
+
+	vx := (1-s) * ((1-t) * vx00 + t * vx01) + s * ((1-t) * vx10 + t * vx11)
+	vy := (1-s) * ((1-t) * vy00 + t * vy01) + s * ((1-t) * vy10 + t * vy11)
+	return vx, vy
+}
+
+// Mixes the tracer colour into a pixel
+func overlay(base color.RGBA64, tint [3]float32, intensity float32) color.RGBA64 {
+	mix := func(channel uint16, value float32) uint16 {
+		return uint16(float32(channel) * (1 - intensity) + float32(scale(value)) * intensity)
+	}
+	return color.RGBA64{mix(base.R, tint[0]), mix(base.G, tint[1]), mix(base.B, tint[2]), mix(base.A, 1)}
+}
@@ -0,0 +1,38 @@
+package simpletest
+
+import (
+	"fmt"
+	"proj3/fluid"
+	"testing"
+)
+
+const BENCHMARK_SIZE int = 128
+const BENCHMARK_THREADS int = 4
+
+func BenchmarkStepFloat32(b *testing.B) {
+	benchmarkStep(b, "float32")
+}
+
+func BenchmarkStepFloat64(b *testing.B) {
+	benchmarkStep(b, "float64")
+}
+
+// Times a step of a cube in one precision (the random simulation's inputs every
+// tick, like FluidSim), sequentially and split across the worker pool
+func benchmarkStep(b *testing.B, precision string) {
+	for _, threads := range []int{1, BENCHMARK_THREADS} {
+		b.Run(fmt.Sprintf("%dthreads", threads), func(b *testing.B) {
+			size := BENCHMARK_SIZE
+			opts := fluid.Options{Precision: precision}
+			cube := fluid.FluidCubeCreate(size, size, DEFAULT_DIFFUSION, DEFAULT_VISCOSITY, fluid.FLOAT32_MIN, threads, opts)
+			defer cube.Close()
+			b.ResetTimer()
+			for i:=0; i<b.N; i++ {
+				x, y := 1 + i*7 % (size-2), 1 + i*13 % (size-2)
+				cube.AddDensity(x, y, 100)
+				cube.AddVelocity(x, y, 1, -1)
+				cube.Step()
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package simpletest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"proj3/fluid"
+	"sync"
+)
+
+// a job ValidateReproducible runs in every mode
+type reproduceJob struct {
+	simType string
+	opts    fluid.Options
+}
+
+// Checks that a seeded job gives byte-identical gifs when it's run sequentially,
+// with -p and with -p -bsp (through fluid.Worker like the driver), and that another
+// seed gives a different gif.
+func ValidateReproducible() error {
+	dir, err := os.MkdirTemp("", "reproducible"); if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	jobs := []reproduceJob{
+		{"random", fluid.Options{Seed: 42}},
+		{"random", fluid.Options{Seed: 42, Solver: "cg", Dyes: []fluid.Dye{{Color: [3]float32{1, 0, 0}}, {Color: [3]float32{0, 0, 1}}},
+			Tracers: fluid.Tracers{Seed: "random", Count: 50, Trail: 5}, Obstacles: []fluid.Obstacle{{Shape: "circle", X: 32, Y: 32, Radius: 6}}}},
+		{"jet", fluid.Options{Seed: 7, Dt: 0.01}},
+		{"reaction-diffusion", fluid.Options{Seed: 3, Dt: 0.01}},
+		{"random", fluid.Options{Seed: 42, Backend: "flip"}},
+	}
+
+	for i, job := range jobs {
+		name := func(mode string) string {
+			return filepath.Join(dir, fmt.Sprintf("%d-%s.gif", i, mode))
+		}
+		err = runSequential(job, name("sequential")); if err != nil {
+			return err
+		}
+		runWorkers(job, name("parallel"), 3, false)
+		runWorkers(job, name("bsp"), 3, true)
+
+		sequential, err := os.ReadFile(name("sequential")); if err != nil {
+			return err
+		}
+		for _, mode := range []string{"parallel", "bsp"} {
+			other, err := os.ReadFile(name(mode)); if err != nil {
+				return err
+			}
+			if !bytes.Equal(sequential, other) {
+				return fmt.Errorf("reproducible: %s job %d differs between the sequential and %s runs", job.simType, i, mode)
+			}
+		}
+
+		job.opts.Seed++
+		err = runSequential(job, name("reseeded")); if err != nil {
+			return err
+		}
+		reseeded, err := os.ReadFile(name("reseeded")); if err != nil {
+			return err
+		}
+		if bytes.Equal(sequential, reseeded) {
+			return fmt.Errorf("reproducible: %s job %d gives the same gif with another seed", job.simType, i)
+		}
+	}
+	return nil
+}
+
+func runSequential(job reproduceJob, path string) error {
+	sg := fluid.FluidSimulationGIFCreate(64, 64, 40, 2, job.simType, 0.0001, 0.0001, 1, false, path, 0, false, job.opts)
+	sg.Run()
+	sg.Close()
+	return sg.Save()
+}
+
+// runs the job the way the driver does with -p threads (and -bsp)
+func runWorkers(job reproduceJob, path string, threads int, bspMode bool) {
+	sg := fluid.FluidSimulationGIFCreate(64, 64, 40, 2, job.simType, 0.0001, 0.0001, 1, false, path, threads, bspMode, job.opts)
+	tasks := make(chan *fluid.Task, 1)
+	var wg sync.WaitGroup
+	for i:=0; i<threads; i++ {
+		wg.Add(1)
+		go fluid.Worker(tasks, i, threads, &wg, bspMode)
+	}
+	tasks <- fluid.TaskCreate(sg)
+	close(tasks)
+	wg.Wait()
+}
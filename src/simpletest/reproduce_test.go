@@ -0,0 +1,14 @@
+package simpletest
+
+import (
+	"testing"
+)
+
+func TestReproducible(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every job 4 times")
+	}
+	err := ValidateReproducible(); if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,4 +1,4 @@
-// this package is for internal testing, it doesn't work with go test
+// this package is for internal testing, the validation checks in the _test.go files run with go test
 
 package simpletest
 
@@ -40,7 +40,8 @@ func RGBRectangle() {
 
 // Simple function to test proj3/fluid
 func FluidSim() {
-	sg := fluid.FluidSimulationGIFCreate(64, 200, 2, "random", DEFAULT_DIFFUSION, DEFAULT_VISCOSITY, 1, true, "Fluid.gif", 0, false)
+	sg := fluid.FluidSimulationGIFCreate(64, 64, 200, 2, "random", DEFAULT_DIFFUSION, DEFAULT_VISCOSITY, 1, true, "Fluid.gif", 0, false, fluid.Options{})
 	sg.Run()
+	sg.Close()
 	sg.Save()
 }
@@ -0,0 +1,165 @@
+package simpletest
+
+import (
+	"fmt"
+	"math"
+	"proj3/fluid"
+)
+
+// Checks the "validated" physics mode against the analytic solution for diffusion.
+// A gaussian blob of dye keeps its mass and its variance (in cells^2) grows by
+// exactly 2*a per step along each axis, where a = dt * diffusion * (N-2)^2.
+func ValidateDiffusion() error {
+	const N int = 130
+	const steps int = 10
+	const sigma float64 = 8
+	const diffusion float32 = 1
+	dt := 2 / (diffusion * float32(N-2) * float32(N-2)) // a = 2
+
+	opts := fluid.Options{Physics: "validated", DiffuseIterations: 1000, Tolerance: 1e-7}
+	cube := fluid.FluidCubeCreate(N, N, diffusion, 0, dt, 0, opts)
+	defer cube.Close()
+
+	center := float64(N) / 2
+	for y:=1; y<N-1; y++ {
+		for x:=1; x<N-1; x++ {
+			dx, dy := float64(x) - center, float64(y) - center
+			cube.AddDensity(x, y, float32(math.Exp(-(dx*dx + dy*dy) / (2*sigma*sigma))))
+		}
+	}
+
+	mass0, varX0, varY0 := moments(cube, N)
+	for i:=0; i<steps; i++ {
+		cube.Step()
+	}
+	mass, varX, varY := moments(cube, N)
+
+	a := float64(dt * diffusion) * float64(N-2) * float64(N-2)
+	expected := 2 * a * float64(steps)
+	if math.Abs(mass - mass0) > 1e-3 * mass0 {
+		return fmt.Errorf("diffusion: mass changed from %f to %f", mass0, mass)
+	}
+	if math.Abs((varX - varX0) - expected) > 0.01 * expected || math.Abs((varY - varY0) - expected) > 0.01 * expected {
+		return fmt.Errorf("diffusion: variance grew by (%f, %f), expected %f", varX - varX0, varY - varY0, expected)
+	}
+	return nil
+}
+
+// Checks that project() removes the divergence of a smooth velocity field in the
+// "validated" physics mode. The central difference divergence isn't removed
+// exactly by the compact pressure stencil but its root mean square should drop by
+// well over an order of magnitude (the legacy coefficient barely changes it).
+func ValidateProjection() error {
+	const N int = 66
+
+	opts := fluid.Options{Physics: "validated", Solver: "multigrid", PressureIterations: 20}
+	cube := fluid.FluidCubeCreate(N, N, 0, 0, fluid.FLOAT32_MIN, 0, opts)
+	defer cube.Close()
+
+	for y:=1; y<N-1; y++ {
+		for x:=1; x<N-1; x++ {
+			fx, fy := float64(x) / float64(N-1), float64(y) / float64(N-1)
+			vx := math.Sin(math.Pi * fx) * math.Sin(2 * math.Pi * fy)
+			vy := math.Sin(math.Pi * fy) * math.Cos(math.Pi * fx)
+			cube.AddVelocity(x, y, float32(vx), float32(vy))
+		}
+	}
+
+	before := rmsDivergence(cube, N)
+	cube.Step()
+	after := rmsDivergence(cube, N)
+
+	if after > 0.05 * before {
+		return fmt.Errorf("projection: divergence only dropped from %f to %f", before, after)
+	}
+	return nil
+}
+
+// Checks the viscosity of the "lbm" backend with a decaying shear wave. In a periodic
+// box the wave vx = A sin(k y) keeps its shape and decays as exp(-nu k^2 t), where
+// nu = dt * visc * (N-2)^2 is the viscosity in cells^2 per step.
+func ValidateLatticeBoltzmann() error {
+	const N int = 66
+	const steps int = 200
+	const dt float32 = 0.01
+	const nu float64 = 0.1
+	viscosity := float32(nu / (float64(dt) * float64(N-2) * float64(N-2)))
+
+	periodic := fluid.Edge{Type: "periodic"}
+	opts := fluid.Options{Backend: "lbm", Boundary: fluid.Boundaries{Left: periodic, Right: periodic, Top: periodic, Bottom: periodic}}
+	cube := fluid.FluidCubeCreate(N, N, 0, viscosity, dt, 0, opts)
+	defer cube.Close()
+
+	k := 2 * math.Pi / float64(N-2)
+	for y:=1; y<N-1; y++ {
+		for x:=1; x<N-1; x++ {
+			cube.AddVelocity(x, y, float32(0.05 * math.Sin(k * float64(y-1))), 0)
+		}
+	}
+
+	amplitude0 := shearAmplitude(cube, N, k)
+	for i:=0; i<steps; i++ {
+		cube.Step()
+	}
+	amplitude := shearAmplitude(cube, N, k)
+
+	expected := amplitude0 * math.Exp(-nu * k * k * float64(steps))
+	if math.Abs(amplitude - expected) > 0.01 * expected {
+		return fmt.Errorf("lattice boltzmann: shear wave decayed to %f, expected %f", amplitude, expected)
+	}
+	return nil
+}
+
+// total dye and the variance of its distribution along each axis
+func moments(cube *fluid.FluidCube, N int) (float64, float64, float64) {
+	var mass, mx, my float64
+	for y:=0; y<N; y++ {
+		for x:=0; x<N; x++ {
+			d := float64(cube.Density(x, y))
+			mass += d
+			mx += d * float64(x)
+			my += d * float64(y)
+		}
+	}
+	mx, my = mx / mass, my / mass
+
+	var varX, varY float64
+	for y:=0; y<N; y++ {
+		for x:=0; x<N; x++ {
+			d := float64(cube.Density(x, y))
+			varX += d * (float64(x) - mx) * (float64(x) - mx)
+			varY += d * (float64(y) - my) * (float64(y) - my)
+		}
+	}
+	return mass, varX / mass, varY / mass
+}
+
+// Root mean square of the central difference divergence, cells next to the walls
+// are skipped because set_bnd overwrites the velocities they depend on after the
+// projection
+func rmsDivergence(cube *fluid.FluidCube, N int) float64 {
+	var sum float64
+	for y:=2; y<N-2; y++ {
+		for x:=2; x<N-2; x++ {
+			right, _ := cube.Velocity(x+1, y)
+			left, _ := cube.Velocity(x-1, y)
+			_, up := cube.Velocity(x, y+1)
+			_, down := cube.Velocity(x, y-1)
+			div := float64(right - left + up - down) / 2
+			sum += div * div
+		}
+	}
+	return math.Sqrt(sum / float64((N-4) * (N-4)))
+}
+
+// amplitude of the sin(k y) part of vx, averaged over every column
+func shearAmplitude(cube *fluid.FluidCube, N int, k float64) float64 {
+	var sum float64
+	for y:=1; y<N-1; y++ {
+		for x:=1; x<N-1; x++ {
+			vx, _ := cube.Velocity(x, y)
+			sum += float64(vx) * math.Sin(k * float64(y-1))
+		}
+	}
+	return 2 * sum / float64((N-2) * (N-2))
+}
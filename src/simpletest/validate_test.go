@@ -0,0 +1,23 @@
+package simpletest
+
+import (
+	"testing"
+)
+
+func TestValidatedDiffusion(t *testing.T) {
+	err := ValidateDiffusion(); if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatedProjection(t *testing.T) {
+	err := ValidateProjection(); if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatticeBoltzmann(t *testing.T) {
+	err := ValidateLatticeBoltzmann(); if err != nil {
+		t.Fatal(err)
+	}
+}